@@ -1,79 +1,90 @@
 package main
 
 import (
-	"bytes"
 	"context"
-	"encoding/base64"
 	"fmt"
-	"image"
-	"image/jpeg"
+	"io/ioutil"
 	"net/url"
 
+	"github.com/Azure/azure-pipeline-go/pipeline"
 	"github.com/Azure/azure-storage-blob-go/azblob"
-	"github.com/segmentio/ksuid"
 )
 
-const containerName = ""
-const blobName = ""
-
-func accInfo() (string, string, string, string) {
-	azrKey := "azureKEY"
-	azrBlobAccountName := "BlobAccName"
-	azrPrimaryBlobServiceEndpoint := fmt.Sprintf("link/", azrBlobAccountName)
-	azrBlobContainer := "container"
-
-	return azrKey, azrBlobAccountName, azrPrimaryBlobServiceEndpoint, azrBlobContainer
+//AzureStore - BlobStore in an azure storage container
+type AzureStore struct {
+	pipeline     pipeline.Pipeline
+	containerURL string // endpoint + container + "/"
 }
 
-//GetBlobName - dd
-func GetBlobName() string {
-	uuid := ksuid.New().String()
-	return "i" + uuid
-	//return fmt.Sprintf("%s-%v.jpg", t.Format("20060102"), uuid)
+//NewAzureStore - store in the configured account and container
+func NewAzureStore(c StorageConfig) (*AzureStore, error) {
+	credential, err := azblob.NewSharedKeyCredential(c.AzureAccount, c.AzureKey) // Finally we create the credentials object required by the uploader
+	if err != nil {
+		return nil, err
+	}
+	return &AzureStore{
+		pipeline:     azblob.NewPipeline(credential, azblob.PipelineOptions{}),
+		containerURL: fmt.Sprint(c.AzureEndpoint, c.AzureContainer, "/"),
+	}, nil
 }
 
-//UploadBytesToBlob - dd
-func UploadBytesToBlob(b []byte) (string, error) {
-	azrKey, accountName, endPoint, container := accInfo()                  // This is our account info method
-	u, _ := url.Parse(fmt.Sprint(endPoint, container, "/", GetBlobName())) // This uses our Blob Name Generator to create individual blob urls
-	credential, errC := azblob.NewSharedKeyCredential(accountName, azrKey) // Finally we create the credentials object required by the uploader
-	if errC != nil {
-		return "", errC
+//blobURL - Azure Specific object, which combines the URL of the blob and credentials
+func (s *AzureStore) blobURL(name string) (azblob.BlockBlobURL, error) {
+	u, err := url.Parse(s.URL(name))
+	if err != nil {
+		return azblob.BlockBlobURL{}, err
 	}
+	return azblob.NewBlockBlobURL(*u, s.pipeline), nil
+}
 
-	// Another Azure Specific object, which combines our generated URL and credentials
-	blockBlobURL := azblob.NewBlockBlobURL(*u, azblob.NewPipeline(credential, azblob.PipelineOptions{}))
-
-	ctx := context.Background() // We create an empty context (https://golang.org/pkg/context/#Background)
+//Put - ...
+func (s *AzureStore) Put(ctx context.Context, name string, data []byte, contentType string) error {
+	blockBlobURL, err := s.blobURL(name)
+	if err != nil {
+		return err
+	}
 
 	// Provide any needed options to UploadToBlockBlobOptions (https://godoc.org/github.com/Azure/azure-storage-blob-go/azblob#UploadToBlockBlobOptions)
 	o := azblob.UploadToBlockBlobOptions{
 		BlobHTTPHeaders: azblob.BlobHTTPHeaders{
-			ContentType: "image/jpg", //  Add any needed headers here
+			ContentType: contentType, //  Add any needed headers here
 		},
 	}
 
 	// Combine all the pieces and perform the upload using UploadBufferToBlockBlob (https://godoc.org/github.com/Azure/azure-storage-blob-go/azblob#UploadBufferToBlockBlob)
-	_, errU := azblob.UploadBufferToBlockBlob(ctx, b, blockBlobURL, o)
-	return blockBlobURL.String(), errU
+	_, err = azblob.UploadBufferToBlockBlob(ctx, data, blockBlobURL, o)
+	return err
 }
 
-func b64ToJpeg(b64Image string) image.Image {
-	unbased, _ := base64.StdEncoding.DecodeString(b64Image)
-	res := bytes.NewReader(unbased)
-	image, err := jpeg.Decode(res)
+//Get - ...
+func (s *AzureStore) Get(ctx context.Context, name string) ([]byte, error) {
+	blockBlobURL, err := s.blobURL(name)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := blockBlobURL.Download(ctx, 0, azblob.CountToEnd, azblob.BlobAccessConditions{}, false, azblob.ClientProvidedKeyOptions{})
 	if err != nil {
-		fmt.Println("error converting to jpeg")
+		return nil, err
 	}
-	return image
+	body := resp.Body(azblob.RetryReaderOptions{})
+	defer body.Close()
+	return ioutil.ReadAll(body)
 }
 
-//JpegToBytes - dd
-func JpegToBytes(nImage image.Image) []byte {
-	buf := new(bytes.Buffer)
-	err := jpeg.Encode(buf, nImage, nil)
+//Delete - ...
+func (s *AzureStore) Delete(ctx context.Context, name string) error {
+	blockBlobURL, err := s.blobURL(name)
 	if err != nil {
-		fmt.Println("error transforming image")
+		return err
 	}
-	return buf.Bytes()
+	_, err = blockBlobURL.Delete(ctx, azblob.DeleteSnapshotsOptionInclude, azblob.BlobAccessConditions{})
+	if stgErr, ok := err.(azblob.StorageError); ok && stgErr.ServiceCode() == azblob.ServiceCodeBlobNotFound {
+		return nil
+	}
+	return err
+}
+
+//URL - ...
+func (s *AzureStore) URL(name string) string {
+	return s.containerURL + name
 }
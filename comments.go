@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/segmentio/ksuid"
+	log "github.com/sirupsen/logrus"
+)
+
+//Comment - a comment on a message, or a reply to another comment when ParentCID is set
+type Comment struct {
+	CID        string `json:"cid" bson:"cid"`
+	MID        string `json:"mid" bson:"mid"`
+	UID        string `json:"uid" bson:"uid"`
+	ParentCID  string `json:"parent_cid,omitempty" bson:"parent_cid,omitempty"`
+	Text       string `json:"text" bson:"text" validate:"required,min=1,max=500"`
+	Date       int64  `json:"date" bson:"date"`
+	EvalValue  int    `json:"eval_value" bson:"eval_value"`
+	ReplyCount int    `json:"reply_count" bson:"reply_count"`
+	UserEval   string `json:"user_eval,omitempty" bson:"-"`
+}
+
+const (
+	commentsDefaultLimit = 20
+	commentsMaxLimit     = 100
+	commentsMaxPage      = 10000 // page*limit must not overflow the skip
+)
+
+/*createComment - comments on a message or replies to a comment of that message
+* The body has the text and optionally the parent_cid being replied to
+ */
+func createComment(req *http.Request) Response {
+	tokenAuth, err := ExtractTokenMetadata(req)
+	if err != nil {
+		return Response{Error: true, Msg: err.Error()}
+	}
+	MID := mux.Vars(req)["MID"]
+
+	decoder := json.NewDecoder(req.Body)
+	var c Comment
+	err = decoder.Decode(&c)
+	if err != nil {
+		fmt.Println("Failed to read request.")
+		return Response{Error: true, Msg: "Failed to read request."}
+	}
+	if !_validateInput(c) {
+		return Response{Error: true, Msg: "Comment sent was invalid. Post Failed"}
+	}
+
+	msg, err := DBGetMessage(MID)
+	if err != nil || !canSeeMessage(msg, tokenAuth.UID) {
+		return Response{Error: true, Msg: "Message does not exist"}
+	}
+	if c.ParentCID != "" {
+		parent, err := DBGetComment(c.ParentCID)
+		if err != nil || parent.MID != MID {
+			return Response{Error: true, Msg: "Comment being replied to does not exist"}
+		}
+	}
+
+	c.CID = "c" + ksuid.New().String()
+	c.MID = MID
+	c.UID = tokenAuth.UID
+	c.Date = time.Now().Unix()
+	c.EvalValue = 0
+	c.ReplyCount = 0
+
+	if DBCreateComment(&c) != nil {
+		log.WithFields(log.Fields{
+			"uid": c.UID, "mid": MID, "request": "createComment",
+		}).Info("Failed to create comment")
+		return Response{Error: true, Msg: "Error in the DB"}
+	}
+
+	dataResp, err := json.Marshal(c)
+	if err != nil {
+		return Response{Error: true, Msg: err.Error()}
+	}
+	return Response{Error: false, Msg: "Comment posted successfully", Data: dataResp}
+}
+
+/*listComments - lists the comments of a message, oldest first
+* With the parent query parameter lists the replies to that comment instead.
+* Paginated with page (starting at 0) and limit
+ */
+func listComments(req *http.Request) Response {
+	tokenAuth, err := ExtractTokenMetadata(req)
+	if err != nil {
+		return Response{Error: true, Msg: err.Error()}
+	}
+	MID := mux.Vars(req)["MID"]
+	qParams := req.URL.Query()
+	parent := qParams.Get("parent")
+
+	page, limit, err := pageParams(qParams)
+	if err != nil {
+		return Response{Error: true, Msg: err.Error()}
+	}
+	msg, err := DBGetMessage(MID)
+	if err != nil || !canSeeMessage(msg, tokenAuth.UID) {
+		return Response{Error: true, Msg: "Message does not exist"}
+	}
+
+	results, err := DBListComments(MID, parent, page, limit)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"uid": tokenAuth.UID, "request": "listComments",
+		}).Info(err)
+		return Response{Error: true, Msg: "Error in the database"}
+	}
+	CIDs := make([]string, len(results))
+	for i, r := range results {
+		CIDs[i] = r.CID
+	}
+	evals, err := DBCheckUserCommentEvals(tokenAuth.UID, CIDs)
+	if err != nil {
+		return Response{Error: true, Msg: "Error in the database"}
+	}
+	for i := range results {
+		results[i].UserEval = evals[results[i].CID]
+	}
+
+	dataResp, err := json.Marshal(results)
+	if err != nil {
+		return Response{Error: true, Msg: err.Error()}
+	}
+	return Response{Error: false, Msg: "Request successfully completed", Data: dataResp}
+}
+
+/*updateCommentEval - upvotes or downvotes a comment, same rules as messages
+*
+ */
+func updateCommentEval(req *http.Request) Response {
+	tokenAuth, err := ExtractTokenMetadata(req)
+	if err != nil {
+		return Response{Error: true, Msg: err.Error()}
+	}
+	eval := req.URL.Query().Get("eval")
+	CID := mux.Vars(req)["CID"]
+
+	msg, err := DBGetMessage(mux.Vars(req)["MID"])
+	if err != nil || !canSeeMessage(msg, tokenAuth.UID) {
+		return Response{Error: true, Msg: "Message does not exist"}
+	}
+	c, err := DBGetComment(CID)
+	if err != nil || c.MID != msg.MID {
+		return Response{Error: true, Msg: "Comment does not exist"}
+	}
+
+	err = DBUpdateCommentEval(CID, tokenAuth.UID, eval)
+	if err != nil {
+		return Response{Error: true, Msg: "Could not Like/Dislike this comment"}
+	}
+	return Response{Error: false, Msg: "Likes/Dislikes updated successfully"}
+}
+
+//pageParams - reads page and limit query parameters, limit defaults to commentsDefaultLimit
+func pageParams(qParams url.Values) (int64, int64, error) {
+	var page, limit int64 = 0, commentsDefaultLimit
+	var err error
+	if p := qParams.Get("page"); p != "" {
+		page, err = strconv.ParseInt(p, 10, 64)
+		if err != nil || page < 0 || page > commentsMaxPage {
+			return 0, 0, errors.New("Page invalid")
+		}
+	}
+	if l := qParams.Get("limit"); l != "" {
+		limit, err = strconv.ParseInt(l, 10, 64)
+		if err != nil || limit < 1 || limit > commentsMaxLimit {
+			return 0, 0, errors.New("Limit invalid")
+		}
+	}
+	return page, limit, nil
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+//Config - settings of the server
+type Config struct {
+	ListenAddr string `yaml:"listen_addr"`
+	PublicURL  string `yaml:"public_url"`  // used in the links sent by email
+	TrustProxy bool   `yaml:"trust_proxy"` // take the client IP from X-Forwarded-For
+
+	Keys            KeysConfig    `yaml:"keys"`
+	AccessLifetime  time.Duration `yaml:"access_lifetime"`
+	RefreshLifetime time.Duration `yaml:"refresh_lifetime"`
+
+	MongoURI string `yaml:"mongo_uri"`
+	MongoDB  string `yaml:"mongo_db"`
+
+	TokensRedisAddr string `yaml:"tokens_redis_addr"`
+	CodesRedisAddr  string `yaml:"codes_redis_addr"`
+
+	Storage StorageConfig `yaml:"storage"`
+	Mail    MailConfig    `yaml:"mail"`
+
+	MsgDefaultLifetime time.Duration `yaml:"msg_default_lifetime"` // 0 means messages never expire
+	MsgMaxLifetime     time.Duration `yaml:"msg_max_lifetime"`
+	HotGravity         float64       `yaml:"hot_gravity"`
+	HotDistanceScale   float64       `yaml:"hot_distance_scale"`
+}
+
+//KeysConfig - keys that sign the tokens
+type KeysConfig struct {
+	Dir       string        `yaml:"dir"`       // one <kid>.pem file per key, share it between servers
+	Algorithm string        `yaml:"algorithm"` // RS256 or EdDSA
+	Rotation  time.Duration `yaml:"rotation"`  // a new key signs after this, old keys keep verifying
+}
+
+//StorageConfig - where message images are stored
+type StorageConfig struct {
+	Backend        string `yaml:"backend"` // azure, local or s3
+	AzureAccount   string `yaml:"azure_account"`
+	AzureKey       string `yaml:"azure_key"`
+	AzureEndpoint  string `yaml:"azure_endpoint"`
+	AzureContainer string `yaml:"azure_container"`
+	LocalDir       string `yaml:"local_dir"` // served by the server under /images/
+	S3Endpoint     string `yaml:"s3_endpoint"`
+	S3Region       string `yaml:"s3_region"`
+	S3Bucket       string `yaml:"s3_bucket"`
+	S3AccessKey    string `yaml:"s3_access_key"`
+	S3SecretKey    string `yaml:"s3_secret_key"`
+	S3UseSSL       bool   `yaml:"s3_use_ssl"`
+	S3PublicURL    string `yaml:"s3_public_url"` // defaults to the path style url of the bucket
+}
+
+//MailConfig - how emails are sent
+type MailConfig struct {
+	Backend       string `yaml:"backend"` // mailgun, smtp or dev
+	From          string `yaml:"from"`
+	MailgunDomain string `yaml:"mailgun_domain"`
+	MailgunAPIKey string `yaml:"mailgun_api_key"`
+	SMTPHost      string `yaml:"smtp_host"`
+	SMTPPort      int    `yaml:"smtp_port"`
+	SMTPUsername  string `yaml:"smtp_username"` // no authentication if empty
+	SMTPPassword  string `yaml:"smtp_password"`
+	DevDir        string `yaml:"dev_dir"` // dev writes emails here, or to the log if empty
+}
+
+var config *Config = LoadConfig()
+
+/*LoadConfig - reads the configuration, exits if it is invalid
+* Defaults are overridden by the yaml file in MAPPIN_CONFIG (if set), which is overridden by environment variables
+ */
+func LoadConfig() *Config {
+	c := defaultConfig()
+	if path := os.Getenv("MAPPIN_CONFIG"); path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			log.Fatal("config: ", err)
+		}
+		if err = yaml.UnmarshalStrict(data, c); err != nil {
+			log.Fatal("config: ", path, ": ", err)
+		}
+	}
+
+	var errs []string
+	c.fromEnv(&errs)
+	c.check(&errs)
+	if len(errs) > 0 {
+		log.Fatal("config: invalid configuration:\n\t" + strings.Join(errs, "\n\t"))
+	}
+	return c
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		ListenAddr: ":8080",
+		PublicURL:  "https://mappin.hadrons.xyz",
+		Keys: KeysConfig{
+			Dir:       "keys",
+			Algorithm: "RS256",
+			Rotation:  30 * 24 * time.Hour,
+		},
+		AccessLifetime:  60 * time.Minute,
+		RefreshLifetime: 30 * 24 * time.Hour,
+		MongoDB:         "message_poster_app",
+		TokensRedisAddr: "127.0.0.1:6379",
+		CodesRedisAddr:  "127.0.0.1:6380",
+		Storage: StorageConfig{
+			Backend:  "azure",
+			LocalDir: "images",
+			S3UseSSL: true,
+		},
+		Mail: MailConfig{
+			Backend:  "mailgun",
+			From:     "Mappin App <mappin@hadrons.xyz>",
+			SMTPPort: 25,
+		},
+		HotGravity:       1.5,
+		HotDistanceScale: 5000,
+	}
+}
+
+//fromEnv - overrides the settings that have an environment variable set
+func (c *Config) fromEnv(errs *[]string) {
+	envString(&c.ListenAddr, "LISTEN_ADDR")
+	envString(&c.PublicURL, "PUBLIC_URL")
+	envBool(&c.TrustProxy, "TRUST_PROXY", errs)
+	envString(&c.Keys.Dir, "KEYS_DIR")
+	envString(&c.Keys.Algorithm, "KEYS_ALGORITHM")
+	envDuration(&c.Keys.Rotation, "KEYS_ROTATION", errs)
+	envDuration(&c.AccessLifetime, "ACCESS_LIFETIME", errs)
+	envDuration(&c.RefreshLifetime, "REFRESH_LIFETIME", errs)
+	envString(&c.MongoURI, "MONGO_URI")
+	envString(&c.MongoDB, "MONGO_DB")
+	envString(&c.TokensRedisAddr, "TOKENS_REDIS_ADDR")
+	envString(&c.CodesRedisAddr, "CODES_REDIS_ADDR")
+
+	envString(&c.Storage.Backend, "STORAGE_BACKEND")
+	envString(&c.Storage.AzureAccount, "AZURE_ACCOUNT")
+	envString(&c.Storage.AzureKey, "AZURE_KEY")
+	envString(&c.Storage.AzureEndpoint, "AZURE_ENDPOINT")
+	envString(&c.Storage.AzureContainer, "AZURE_CONTAINER")
+	envString(&c.Storage.LocalDir, "STORAGE_LOCAL_DIR")
+	envString(&c.Storage.S3Endpoint, "S3_ENDPOINT")
+	envString(&c.Storage.S3Region, "S3_REGION")
+	envString(&c.Storage.S3Bucket, "S3_BUCKET")
+	envString(&c.Storage.S3AccessKey, "S3_ACCESS_KEY")
+	envString(&c.Storage.S3SecretKey, "S3_SECRET_KEY")
+	envBool(&c.Storage.S3UseSSL, "S3_USE_SSL", errs)
+	envString(&c.Storage.S3PublicURL, "S3_PUBLIC_URL")
+
+	envString(&c.Mail.Backend, "MAIL_BACKEND")
+	envString(&c.Mail.From, "MAIL_FROM")
+	envString(&c.Mail.MailgunDomain, "MAILGUN_DOMAIN")
+	envString(&c.Mail.MailgunAPIKey, "MAILGUN_API_KEY")
+	envString(&c.Mail.SMTPHost, "SMTP_HOST")
+	envInt(&c.Mail.SMTPPort, "SMTP_PORT", errs)
+	envString(&c.Mail.SMTPUsername, "SMTP_USERNAME")
+	envString(&c.Mail.SMTPPassword, "SMTP_PASSWORD")
+	envString(&c.Mail.DevDir, "MAIL_DEV_DIR")
+
+	envDuration(&c.MsgDefaultLifetime, "MSG_DEFAULT_LIFETIME", errs)
+	envDuration(&c.MsgMaxLifetime, "MSG_MAX_LIFETIME", errs)
+	envFloat(&c.HotGravity, "HOT_GRAVITY", errs)
+	envFloat(&c.HotDistanceScale, "HOT_DISTANCE_SCALE", errs)
+}
+
+//check - adds an error for every missing or invalid setting
+func (c *Config) check(errs *[]string) {
+	required := func(val string, name string) {
+		if val == "" {
+			*errs = append(*errs, name+" is required")
+		}
+	}
+	required(c.ListenAddr, "listen_addr (LISTEN_ADDR)")
+	required(c.PublicURL, "public_url (PUBLIC_URL)")
+	required(c.Keys.Dir, "keys.dir (KEYS_DIR)")
+	if c.Keys.Algorithm != "RS256" && c.Keys.Algorithm != "EdDSA" {
+		*errs = append(*errs, fmt.Sprintf("keys.algorithm (KEYS_ALGORITHM) %q is not one of: RS256, EdDSA", c.Keys.Algorithm))
+	}
+	if c.Keys.Rotation <= 0 {
+		*errs = append(*errs, "keys.rotation (KEYS_ROTATION) must be positive")
+	}
+	required(c.MongoURI, "mongo_uri (MONGO_URI)")
+	required(c.MongoDB, "mongo_db (MONGO_DB)")
+	required(c.TokensRedisAddr, "tokens_redis_addr (TOKENS_REDIS_ADDR)")
+	required(c.CodesRedisAddr, "codes_redis_addr (CODES_REDIS_ADDR)")
+	if c.AccessLifetime <= 0 || c.RefreshLifetime <= 0 {
+		*errs = append(*errs, "access_lifetime and refresh_lifetime must be positive")
+	}
+	if c.MsgDefaultLifetime < 0 || c.MsgMaxLifetime < 0 {
+		*errs = append(*errs, "msg_default_lifetime and msg_max_lifetime can't be negative")
+	}
+	if c.HotDistanceScale <= 0 {
+		*errs = append(*errs, "hot_distance_scale must be positive")
+	}
+
+	switch c.Storage.Backend {
+	case "azure":
+		required(c.Storage.AzureAccount, "storage.azure_account (AZURE_ACCOUNT)")
+		required(c.Storage.AzureKey, "storage.azure_key (AZURE_KEY)")
+		required(c.Storage.AzureContainer, "storage.azure_container (AZURE_CONTAINER)")
+		if c.Storage.AzureEndpoint == "" {
+			c.Storage.AzureEndpoint = fmt.Sprintf("https://%s.blob.core.windows.net/", c.Storage.AzureAccount)
+		}
+	case "local":
+		required(c.Storage.LocalDir, "storage.local_dir (STORAGE_LOCAL_DIR)")
+	case "s3":
+		required(c.Storage.S3Endpoint, "storage.s3_endpoint (S3_ENDPOINT)")
+		required(c.Storage.S3Bucket, "storage.s3_bucket (S3_BUCKET)")
+		required(c.Storage.S3AccessKey, "storage.s3_access_key (S3_ACCESS_KEY)")
+		required(c.Storage.S3SecretKey, "storage.s3_secret_key (S3_SECRET_KEY)")
+	default:
+		*errs = append(*errs, fmt.Sprintf("storage.backend (STORAGE_BACKEND) %q is not one of: azure, local, s3", c.Storage.Backend))
+	}
+
+	required(c.Mail.From, "mail.from (MAIL_FROM)")
+	switch c.Mail.Backend {
+	case "mailgun":
+		required(c.Mail.MailgunDomain, "mail.mailgun_domain (MAILGUN_DOMAIN)")
+		required(c.Mail.MailgunAPIKey, "mail.mailgun_api_key (MAILGUN_API_KEY)")
+	case "smtp":
+		required(c.Mail.SMTPHost, "mail.smtp_host (SMTP_HOST)")
+		if c.Mail.SMTPPort <= 0 {
+			*errs = append(*errs, "mail.smtp_port (SMTP_PORT) must be positive")
+		}
+	case "dev":
+	default:
+		*errs = append(*errs, fmt.Sprintf("mail.backend (MAIL_BACKEND) %q is not one of: mailgun, smtp, dev", c.Mail.Backend))
+	}
+}
+
+func envString(dst *string, name string) {
+	if val, ok := os.LookupEnv(name); ok {
+		*dst = val
+	}
+}
+
+func envDuration(dst *time.Duration, name string, errs *[]string) {
+	val, ok := os.LookupEnv(name)
+	if !ok {
+		return
+	}
+	d, err := time.ParseDuration(val)
+	if err != nil {
+		*errs = append(*errs, fmt.Sprintf("%s %q is not a duration like 90m or 24h", name, val))
+		return
+	}
+	*dst = d
+}
+
+func envInt(dst *int, name string, errs *[]string) {
+	val, ok := os.LookupEnv(name)
+	if !ok {
+		return
+	}
+	i, err := strconv.Atoi(val)
+	if err != nil {
+		*errs = append(*errs, fmt.Sprintf("%s %q is not an integer", name, val))
+		return
+	}
+	*dst = i
+}
+
+func envBool(dst *bool, name string, errs *[]string) {
+	val, ok := os.LookupEnv(name)
+	if !ok {
+		return
+	}
+	b, err := strconv.ParseBool(val)
+	if err != nil {
+		*errs = append(*errs, fmt.Sprintf("%s %q is not true or false", name, val))
+		return
+	}
+	*dst = b
+}
+
+func envFloat(dst *float64, name string, errs *[]string) {
+	val, ok := os.LookupEnv(name)
+	if !ok {
+		return
+	}
+	f, err := strconv.ParseFloat(val, 64)
+	if err != nil {
+		*errs = append(*errs, fmt.Sprintf("%s %q is not a number", name, val))
+		return
+	}
+	*dst = f
+}
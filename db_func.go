@@ -16,13 +16,16 @@ import (
 
 //Client -- client go mongodb
 var (
-	Client          *mongo.Client     = DBConnect() //probably return this and redis directly from function and assign here
-	appDB           *mongo.Database   = Client.Database("message_poster_app")
-	usersColl       *mongo.Collection = appDB.Collection("users")
-	messagesColl    *mongo.Collection = appDB.Collection("messages")
-	likesColl       *mongo.Collection = appDB.Collection("likes")
-	friendshipsColl *mongo.Collection = appDB.Collection("friendships")
-	friendsReqsColl *mongo.Collection = appDB.Collection("friends_requests")
+	Client           *mongo.Client     = DBConnect() //probably return this and redis directly from function and assign here
+	appDB            *mongo.Database   = Client.Database(config.MongoDB)
+	usersColl        *mongo.Collection = appDB.Collection("users")
+	messagesColl     *mongo.Collection = appDB.Collection("messages")
+	likesColl        *mongo.Collection = appDB.Collection("likes")
+	friendshipsColl  *mongo.Collection = appDB.Collection("friendships")
+	friendsReqsColl  *mongo.Collection = appDB.Collection("friends_requests")
+	commentsColl     *mongo.Collection = appDB.Collection("comments")
+	commentLikesColl *mongo.Collection = appDB.Collection("comment_likes")
+	deletionsColl    *mongo.Collection = appDB.Collection("account_deletions")
 )
 
 //Collection is a handle to a MongoDB collection. It is safe for concurrent use by multiple goroutines. (from godocs -mongodb)
@@ -37,7 +40,7 @@ func DBConnect() *mongo.Client {
 	defer cancel()
 
 	clientLocal, err := mongo.Connect(ctx, options.Client().ApplyURI(
-		"mongoURI"))
+		config.MongoURI))
 	if err != nil {
 		fmt.Println("error connection to DB")
 		log.Fatal(err)
@@ -56,8 +59,8 @@ func DBGetHash(email string) (string, string, bool, error) {
 
 	var result User
 	projection := bson.M{"_id": 0, "uid": 1, "password": 1, "validated_account": 1} // which fields are returned?
-	err := usersColl.FindOne(ctx, bson.M{"email": email}, options.FindOne().SetProjection(projection)).Decode(&result)
-	fmt.Println(result) //TODO: to not receive _id it is necessary to change something in the project in mongodb
+	filter := bson.M{"email": email, "deleted": bson.M{"$ne": true}}                // accounts being deleted can't log in
+	err := usersColl.FindOne(ctx, filter, options.FindOne().SetProjection(projection)).Decode(&result)
 	if err != nil {
 		// ErrNoDocuments means that the filter did not match any documents in the collection
 		if err == mongo.ErrNoDocuments {
@@ -84,6 +87,147 @@ func DBValidateUser(UID string) error {
 	return nil
 }
 
+//DBGetPasswordHash - password hash of the user with this UID
+func DBGetPasswordHash(UID string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var result User
+	projection := bson.M{"_id": 0, "password": 1}
+	err := usersColl.FindOne(ctx, bson.M{"uid": UID}, options.FindOne().SetProjection(projection)).Decode(&result)
+	if err != nil {
+		return "", err
+	}
+	return result.Password, nil
+}
+
+//DBUpdateEmail - sets the email of the user
+func DBUpdateEmail(UID string, email string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	res, err := usersColl.UpdateOne(ctx, bson.M{"uid": UID}, bson.M{"$set": bson.M{"email": email}})
+	if err != nil {
+		fmt.Println(err)
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+	return nil
+}
+
+//DBUpdatePassword - sets the password hash of the user
+func DBUpdatePassword(UID string, hash string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	res, err := usersColl.UpdateOne(ctx, bson.M{"uid": UID}, bson.M{"$set": bson.M{"password": hash}})
+	if err != nil {
+		fmt.Println(err)
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+	return nil
+}
+
+//DBGetTOTP - two factor authentication state of the user
+func DBGetTOTP(UID string) (*TOTPInfo, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var info TOTPInfo
+	projection := bson.M{"_id": 0, "totp_enabled": 1, "totp_secret": 1, "totp_pending_secret": 1, "totp_last_step": 1, "recovery_codes": 1}
+	err := usersColl.FindOne(ctx, bson.M{"uid": UID}, options.FindOne().SetProjection(projection)).Decode(&info)
+	if err != nil {
+		fmt.Println(err)
+		return nil, err
+	}
+	return &info, nil
+}
+
+//DBSetPendingTOTP - saves a secret that is not in use until it is verified
+func DBSetPendingTOTP(UID string, secret string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := usersColl.UpdateOne(ctx, bson.M{"uid": UID, "totp_enabled": bson.M{"$ne": true}}, bson.M{"$set": bson.M{"totp_pending_secret": secret}})
+	if err != nil {
+		fmt.Println(err)
+	}
+	return err
+}
+
+//DBEnableTOTP - turns two factor authentication on with the secret, step is the one of the code that verified it
+func DBEnableTOTP(UID string, secret string, step int64, recoveryCodes []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	update := bson.M{
+		"$set":   bson.M{"totp_enabled": true, "totp_secret": secret, "totp_last_step": step, "recovery_codes": recoveryCodes},
+		"$unset": bson.M{"totp_pending_secret": ""},
+	}
+	_, err := usersColl.UpdateOne(ctx, bson.M{"uid": UID}, update)
+	if err != nil {
+		fmt.Println(err)
+	}
+	return err
+}
+
+//DBDisableTOTP - turns two factor authentication off and forgets the secret and recovery codes
+func DBDisableTOTP(UID string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	update := bson.M{
+		"$set":   bson.M{"totp_enabled": false},
+		"$unset": bson.M{"totp_secret": "", "totp_pending_secret": "", "totp_last_step": "", "recovery_codes": ""},
+	}
+	_, err := usersColl.UpdateOne(ctx, bson.M{"uid": UID}, update)
+	if err != nil {
+		fmt.Println(err)
+	}
+	return err
+}
+
+/*DBUseTOTPStep - records that the code of this time step was used
+* Fails if the same or a later step was already used, so two requests can't use one code
+ */
+func DBUseTOTPStep(UID string, step int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	filter := bson.M{"uid": UID, "totp_last_step": bson.M{"$lt": step}}
+	res, err := usersColl.UpdateOne(ctx, filter, bson.M{"$set": bson.M{"totp_last_step": step}})
+	if err != nil {
+		fmt.Println(err)
+		return err
+	}
+	if res.ModifiedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+	return nil
+}
+
+//DBUseRecoveryCode - removes the recovery code of the user with this hash, ErrNoDocuments if there is none
+func DBUseRecoveryCode(UID string, hash string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	filter := bson.M{"uid": UID, "totp_enabled": true, "recovery_codes": hash}
+	res, err := usersColl.UpdateOne(ctx, filter, bson.M{"$pull": bson.M{"recovery_codes": hash}})
+	if err != nil {
+		fmt.Println(err)
+		return err
+	}
+	if res.ModifiedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+	return nil
+}
+
 /*DBExistsUser - check if a specific user exists in the DB by email
 *
 *
@@ -123,6 +267,21 @@ func DBInsertUser(u *User) error {
 
 }
 
+//DBUpdateUserImage - sets the profile image of the user, returns the previous one
+func DBUpdateUserImage(UID string, imageURL string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var old User
+	opts := options.FindOneAndUpdate().SetProjection(bson.M{"_id": 0, "image": 1})
+	err := usersColl.FindOneAndUpdate(ctx, bson.M{"uid": UID}, bson.M{"$set": bson.M{"image": imageURL}}, opts).Decode(&old)
+	if err != nil {
+		fmt.Println(err)
+		return "", err
+	}
+	return old.Image, nil
+}
+
 /*DBCreateMessage - create the message in the DB.
 *
 *
@@ -143,6 +302,85 @@ func DBCreateMessage(msg *Message) error {
 
 }
 
+/*DBGetMessage - returns the message with this MID
+*
+ */
+func DBGetMessage(MID string) (*Message, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var msg Message
+	err := messagesColl.FindOne(ctx, bson.M{"mid": MID}).Decode(&msg)
+	if err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
+
+/*DBEditMessage - replaces the title and text of a message
+* The previous version is pushed to edit_history
+ */
+func DBEditMessage(msg *Message, title string, text string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	written := msg.Date
+	if msg.EditedAt != 0 {
+		written = msg.EditedAt
+	}
+	old := MessageEdit{Title: msg.Title, Text: msg.Text, Date: written}
+	update := bson.M{
+		"$set":  bson.M{"title": title, "text": text, "edited_at": time.Now().Unix()},
+		"$push": bson.M{"edit_history": old},
+	}
+	filter := bson.M{"mid": msg.MID, "uid": msg.UID, "$or": []bson.M{ // not once it expired
+		{"expires_at": bson.M{"$exists": false}},
+		{"expires_at": bson.M{"$gt": time.Now().Unix()}},
+	}}
+	res, err := messagesColl.UpdateOne(ctx, filter, update)
+	if err != nil {
+		fmt.Println("db error editing message")
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+	return nil
+}
+
+/*DBDeleteMessage - deletes a message written by UID and all its evaluations
+*
+ */
+func DBDeleteMessage(MID string, UID string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	session, err := Client.StartSession()
+	if err != nil {
+		return err
+	}
+	defer session.EndSession(ctx)
+
+	// in a transaction, so a message is never gone while its evaluations and comments are left behind
+	_, err = session.WithTransaction(ctx, func(sc mongo.SessionContext) (interface{}, error) {
+		res, err := messagesColl.DeleteOne(sc, bson.M{"mid": MID, "uid": UID})
+		if err != nil {
+			fmt.Println("db error deleting message")
+			return nil, err
+		}
+		if res.DeletedCount == 0 {
+			return nil, mongo.ErrNoDocuments
+		}
+		_, err = likesColl.DeleteMany(sc, bson.M{"mid": MID})
+		if err != nil {
+			fmt.Println("db error deleting evaluations of message")
+			return nil, err
+		}
+		return nil, deleteComments(sc, []string{MID})
+	})
+	return err
+}
+
 /*DBUpdateLocation - xxx
 *
  */
@@ -150,7 +388,9 @@ func DBUpdateLocation(l *Location, uid string) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	singleResult := usersColl.FindOneAndUpdate(ctx, bson.M{"uid": uid}, bson.M{"location": l})
+	// not stored for users that turned the location off
+	filter := bson.M{"uid": uid, "settings.disable_location": bson.M{"$ne": true}}
+	singleResult := usersColl.FindOneAndUpdate(ctx, filter, bson.M{"$set": bson.M{"location": l}})
 	if err := singleResult.Err(); err != nil {
 		//log.Fatal(err)
 		return err
@@ -158,19 +398,24 @@ func DBUpdateLocation(l *Location, uid string) error {
 	return nil
 }
 
-/*DBQueryMessages - Retrieve the messages in a certain radius of this latitude and longitude
-*
-*
+/*DBQueryMessages - Retrieve the messages in a radius around area.Near or inside area.Within
+* Messages queried by radius have their distance_m. order is new, best, hot or near (only with a radius).
+* Returns at most limit messages, starting after the cursor when one is given
  */
-func DBQueryMessages(location Location, radius int, UID string, order string, group string) ([]Message, error) {
+func DBQueryMessages(area MsgArea, UID string, order string, group string, after *FeedCursor, limit int64) ([]Message, error) {
 	//WHen do we update location? maybe don't need to save user location, just retrieve it when asking for the messages
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
 	var ordSet string
-	if order == "new" {
+	switch order {
+	case "new":
 		ordSet = "date"
-	} else {
+	case "near":
+		ordSet = "distance_m"
+	case "hot":
+		ordSet = "hot_score"
+	default:
 		ordSet = "eval_value"
 	}
 
@@ -178,19 +423,66 @@ func DBQueryMessages(location Location, radius int, UID string, order string, gr
 	// use aggregation to return list of UID friends? TODO
 
 	//TODO: maybe only return the message and timestamp here?
-	filter := bson.M{"location": bson.M{"$near": bson.M{"$geometry": location, "$maxDistance": radius}}}
-	opts := options.Find().SetProjection(bson.M{"_id": 0, "location": 0}).SetSort(bson.M{ordSet: -1}).SetLimit(500)
-	if group == "friends" { // if group is friends change filter to also consider friend list
-		userFriends, err := DBListFriend(UID)
+	var pipeline []bson.M
+	if area.Near != nil { // $geoNear has to be the first stage, it filters by radius and adds the distance
+		filter, err := messagesFilter(nil, UID, group)
 		if err != nil {
-			fmt.Printf("error listing friends")
 			return nil, err
 		}
-		filter = bson.M{"location": bson.M{"$near": bson.M{"$geometry": location, "$maxDistance": radius}}, "uid": bson.M{"$in": userFriends}}
+		geoNear := bson.M{"near": area.Near, "distanceField": "distance_m", "maxDistance": area.Radius, "spherical": true, "query": filter}
+		if after != nil && order == "near" {
+			geoNear["minDistance"] = after.Distance
+		}
+		pipeline = append(pipeline, bson.M{"$geoNear": geoNear})
+	} else {
+		filter, err := messagesFilter(bson.M{"$geoWithin": bson.M{"$geometry": area.Within}}, UID, group)
+		if err != nil {
+			return nil, err
+		}
+		pipeline = append(pipeline, bson.M{"$match": filter})
+	}
 
+	if order == "hot" { // the score depends on the time, later pages use the time of the first one
+		now := time.Now().Unix()
+		if after != nil {
+			now = after.Now
+		}
+		pipeline = append(pipeline, bson.M{"$addFields": bson.M{"hot_score": hotScore(now, area.Near != nil)}})
 	}
 
-	cursor, err := messagesColl.Find(ctx, filter, opts)
+	// mid breaks ties so that the order is stable between pages
+	sort := bson.D{{Key: ordSet, Value: -1}, {Key: "mid", Value: -1}}
+	if order == "near" {
+		sort = bson.D{{Key: ordSet, Value: 1}, {Key: "mid", Value: 1}}
+	}
+	if after != nil { // only what comes after the last message of the previous page
+		var afterFilter bson.M
+		switch order {
+		case "near":
+			afterFilter = bson.M{"$or": []bson.M{
+				bson.M{ordSet: bson.M{"$gt": after.Distance}},
+				bson.M{ordSet: after.Distance, "mid": bson.M{"$gt": after.MID}},
+			}}
+		case "hot":
+			afterFilter = bson.M{"$or": []bson.M{
+				bson.M{ordSet: bson.M{"$lt": after.Score}},
+				bson.M{ordSet: after.Score, "mid": bson.M{"$lt": after.MID}},
+			}}
+		default:
+			afterFilter = bson.M{"$or": []bson.M{
+				bson.M{ordSet: bson.M{"$lt": after.Value}},
+				bson.M{ordSet: after.Value, "mid": bson.M{"$lt": after.MID}},
+			}}
+		}
+		pipeline = append(pipeline, bson.M{"$match": afterFilter})
+	}
+	pipeline = append(pipeline,
+		bson.M{"$sort": sort},
+		bson.M{"$limit": limit},
+		bson.M{"$project": bson.M{"_id": 0, "location": 0, "edit_history": 0}}, // the history is only sent by getMsgHistory
+	)
+
+	cursor, err := messagesColl.Aggregate(ctx, pipeline)
 	if err != nil {
 		return nil, err
 	}
@@ -206,15 +498,133 @@ func DBQueryMessages(location Location, radius int, UID string, order string, gr
 	return res, nil
 }
 
+/*DBClusterMessages - groups the messages matching geoFilter in square cells of cellSize degrees
+* Each cluster has the number of messages, their centroid and the best evaluated one
+ */
+func DBClusterMessages(geoFilter bson.M, UID string, group string, cellSize float64) ([]Cluster, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	filter, err := messagesFilter(geoFilter, UID, group)
+	if err != nil {
+		return nil, err
+	}
+	pipeline := []bson.M{
+		bson.M{"$match": filter},
+		bson.M{"$sort": bson.M{"eval_value": -1}}, // so that $first is the top message of the cell
+		bson.M{"$group": bson.M{
+			"_id": bson.M{
+				"x": bson.M{"$floor": bson.M{"$divide": []interface{}{"$longitude", cellSize}}},
+				"y": bson.M{"$floor": bson.M{"$divide": []interface{}{"$latitude", cellSize}}},
+			},
+			"count":     bson.M{"$sum": 1},
+			"latitude":  bson.M{"$avg": "$latitude"},
+			"longitude": bson.M{"$avg": "$longitude"},
+			"top":       bson.M{"$first": "$$ROOT"},
+		}},
+		bson.M{"$project": bson.M{"_id": 0, "top._id": 0, "top.location": 0, "top.edit_history": 0}},
+	}
+	cursor, err := messagesColl.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	res := []Cluster{}
+	if err = cursor.All(ctx, &res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+/*DBDeleteExpiredMessages - deletes messages past their expires_at, their evaluations and their comments
+* Each message goes in its own transaction, like DBDeleteMessage. Returns the images of the deleted messages
+* so they can be removed from storage, also when a later message failed
+ */
+func DBDeleteExpiredMessages() ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	filter := bson.M{"expires_at": bson.M{"$lte": time.Now().Unix()}}
+	cursor, err := messagesColl.Find(ctx, filter, options.Find().SetProjection(bson.M{"_id": 0, "mid": 1, "image": 1}))
+	if err != nil {
+		return nil, err
+	}
+	var expired []Message
+	if err = cursor.All(ctx, &expired); err != nil {
+		return nil, err
+	}
+	if len(expired) == 0 {
+		return nil, nil
+	}
+
+	session, err := Client.StartSession()
+	if err != nil {
+		return nil, err
+	}
+	defer session.EndSession(ctx)
+
+	var images []string
+	for _, msg := range expired {
+		_, err = session.WithTransaction(ctx, func(sc mongo.SessionContext) (interface{}, error) {
+			res, err := messagesColl.DeleteOne(sc, bson.M{"mid": msg.MID, "expires_at": bson.M{"$lte": time.Now().Unix()}})
+			if err != nil {
+				fmt.Println("db error deleting expired message")
+				return nil, err
+			}
+			if res.DeletedCount == 0 { // deleted by its author in the meantime
+				return nil, mongo.ErrNoDocuments
+			}
+			_, err = likesColl.DeleteMany(sc, bson.M{"mid": msg.MID})
+			if err != nil {
+				fmt.Println("db error deleting evaluations of expired message")
+				return nil, err
+			}
+			return nil, deleteComments(sc, []string{msg.MID})
+		})
+		if err == mongo.ErrNoDocuments {
+			continue
+		}
+		if err != nil {
+			return images, err
+		}
+		if msg.Image != "" {
+			images = append(images, msg.Image)
+		}
+	}
+	return images, nil
+}
+
 /*DBUpdateEval - changes the number of likes/dislikes in a message
 *
 * TODO - Is it necessary to find if exists and then insert if it does not or remove if it does?
 *
  */
 func DBUpdateEval(MID string, UID string, eval string) error { // eval is1 or 0
+	return updateEvalIn(likesColl, messagesColl, "mid", MID, UID, eval)
+}
+
+/*updateEvalIn - evaluation logic shared by messages and comments
+* evalColl keeps one evaluation per user, targetColl has the eval_value of the evaluated document (found by idKey).
+* Runs in a transaction, so concurrent evaluations of the same user can't make eval_value drift from the evaluations
+* (mongo aborts and WithTransaction retries one of them)
+ */
+func updateEvalIn(evalColl *mongo.Collection, targetColl *mongo.Collection, idKey string, ID string, UID string, eval string) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
+	session, err := Client.StartSession()
+	if err != nil {
+		return err
+	}
+	defer session.EndSession(ctx)
+
+	_, err = session.WithTransaction(ctx, func(sc mongo.SessionContext) (interface{}, error) {
+		return nil, applyEval(sc, evalColl, targetColl, idKey, ID, UID, eval)
+	})
+	return err
+}
+
+//applyEval - the reads and writes of updateEvalIn, ctx carries the transaction
+func applyEval(ctx context.Context, evalColl *mongo.Collection, targetColl *mongo.Collection, idKey string, ID string, UID string, eval string) error {
 	var incV int
 	switch eval {
 	case "upvote":
@@ -225,15 +635,15 @@ func DBUpdateEval(MID string, UID string, eval string) error { // eval is1 or 0
 	}
 	//check if message exists
 	var res bson.M
-	opts := options.FindOne().SetProjection(bson.M{"_id": 0, "eval": 1})             //receive only eval
-	err := likesColl.FindOne(ctx, bson.M{"mid": MID, "uid": UID}, opts).Decode(&res) // if res[eval] == 1 - like || res[eval] == 0 - dislike
-	if err == mongo.ErrNoDocuments {                                                 //NO DOCUMENTS, INSERT EVALUATION
-		_, err = likesColl.InsertOne(ctx, bson.M{"mid": MID, "uid": UID, "eval": eval})
+	opts := options.FindOne().SetProjection(bson.M{"_id": 0, "eval": 1})           //receive only eval
+	err := evalColl.FindOne(ctx, bson.M{idKey: ID, "uid": UID}, opts).Decode(&res) // if res[eval] == 1 - like || res[eval] == 0 - dislike
+	if err == mongo.ErrNoDocuments {                                               //NO DOCUMENTS, INSERT EVALUATION
+		_, err = evalColl.InsertOne(ctx, bson.M{idKey: ID, "uid": UID, "eval": eval})
 		if err != nil {
 			fmt.Println("db error inserting evaluation")
 			return err
 		}
-		_, err := messagesColl.UpdateOne(ctx, bson.M{"mid": MID}, bson.M{"$inc": bson.M{"eval_value": incV}})
+		_, err := targetColl.UpdateOne(ctx, bson.M{idKey: ID}, bson.M{"$inc": bson.M{"eval_value": incV}})
 		if err != nil {
 			fmt.Println("db error updating likes/dislikes count")
 			return err
@@ -245,12 +655,12 @@ func DBUpdateEval(MID string, UID string, eval string) error { // eval is1 or 0
 	} else { // ALREADY FOUND ON DB, IF IT IS EQUAL DO FIRST ELSE, DO THE OTHER
 		//case where already evaluated with the same, so remove evaluation
 		if eval == res["eval"] {
-			_, err := likesColl.DeleteOne(ctx, bson.M{"mid": MID, "uid": UID})
+			_, err := evalColl.DeleteOne(ctx, bson.M{idKey: ID, "uid": UID})
 			if err != nil {
 				fmt.Println("Error deleting eval")
 				return err
 			}
-			_, err = messagesColl.UpdateOne(ctx, bson.M{"mid": MID}, bson.M{"$inc": bson.M{"eval_value": -incV}}) //do the opposite, if it has an upvote remove it
+			_, err = targetColl.UpdateOne(ctx, bson.M{idKey: ID}, bson.M{"$inc": bson.M{"eval_value": -incV}}) //do the opposite, if it has an upvote remove it
 			if err != nil {
 				fmt.Println("db error updating likes/dislikes count")
 				return err
@@ -258,12 +668,12 @@ func DBUpdateEval(MID string, UID string, eval string) error { // eval is1 or 0
 			return nil
 		}
 		//case where evaluated with different value, so update
-		_, err = likesColl.UpdateOne(ctx, bson.M{"mid": MID, "uid": UID}, bson.M{"$set": bson.M{"eval": eval}})
+		_, err = evalColl.UpdateOne(ctx, bson.M{idKey: ID, "uid": UID}, bson.M{"$set": bson.M{"eval": eval}})
 		if err != nil {
 			fmt.Println("db error updating evaluation")
 			return err
 		}
-		_, err = messagesColl.UpdateOne(ctx, bson.M{"mid": MID}, bson.M{"$inc": bson.M{"eval_value": 2 * incV}}) //do the opposite, if it has an upvote remove it
+		_, err = targetColl.UpdateOne(ctx, bson.M{idKey: ID}, bson.M{"$inc": bson.M{"eval_value": 2 * incV}}) //do the opposite, if it has an upvote remove it
 		if err != nil {
 			fmt.Println("db error updating likes/dislikes count")
 			return err
@@ -274,6 +684,152 @@ func DBUpdateEval(MID string, UID string, eval string) error { // eval is1 or 0
 
 }
 
+/*DBReconcileEvals - recomputes eval_value of these messages (every message if MIDs is empty) from likesColl
+* Returns how many messages had a wrong eval_value
+ */
+func DBReconcileEvals(MIDs []string) (int64, error) {
+	return reconcileEvalsIn(likesColl, messagesColl, "mid", MIDs)
+}
+
+//DBReconcileCommentEvals - same as DBReconcileEvals for comments
+func DBReconcileCommentEvals(CIDs []string) (int64, error) {
+	return reconcileEvalsIn(commentLikesColl, commentsColl, "cid", CIDs)
+}
+
+/*reconcileEvalsIn - sets eval_value of the documents of targetColl to upvotes - downvotes in evalColl
+* A first pass finds the documents that look wrong, then each one is recounted and fixed in a transaction,
+* so an evaluation made in the meantime is never lost (mongo aborts one of them and WithTransaction retries it)
+ */
+func reconcileEvalsIn(evalColl *mongo.Collection, targetColl *mongo.Collection, idKey string, IDs []string) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+
+	filter := bson.M{}
+	if len(IDs) > 0 {
+		filter = bson.M{idKey: bson.M{"$in": IDs}}
+	}
+	// real value of every evaluated document
+	pipeline := []bson.M{
+		bson.M{"$match": filter},
+		bson.M{"$group": bson.M{
+			"_id":   "$" + idKey,
+			"value": evalSum(),
+		}},
+	}
+	cursor, err := evalColl.Aggregate(ctx, pipeline)
+	if err != nil {
+		return 0, err
+	}
+	var counts []struct {
+		ID    string `bson:"_id"`
+		Value int64  `bson:"value"`
+	}
+	if err = cursor.All(ctx, &counts); err != nil {
+		return 0, err
+	}
+	values := make(map[string]int64, len(counts))
+	for _, c := range counts {
+		values[c.ID] = c.Value
+	}
+
+	cursor, err = targetColl.Find(ctx, filter, options.Find().SetProjection(bson.M{"_id": 0, idKey: 1, "eval_value": 1}))
+	if err != nil {
+		return 0, err
+	}
+	var suspects []string
+	for cursor.Next(ctx) {
+		var doc struct {
+			EvalValue int64 `bson:"eval_value"`
+		}
+		if err = cursor.Decode(&doc); err != nil {
+			cursor.Close(ctx)
+			return 0, err
+		}
+		ID, _ := cursor.Current.Lookup(idKey).StringValueOK()
+		if doc.EvalValue != values[ID] {
+			suspects = append(suspects, ID)
+		}
+	}
+	cursor.Close(ctx)
+	if err = cursor.Err(); err != nil {
+		return 0, err
+	}
+
+	session, err := Client.StartSession()
+	if err != nil {
+		return 0, err
+	}
+	defer session.EndSession(ctx)
+
+	var fixed int64
+	for _, ID := range suspects {
+		var was, now int64
+		_, err = session.WithTransaction(ctx, func(sc mongo.SessionContext) (interface{}, error) {
+			var txErr error
+			was, now, txErr = recountEval(sc, evalColl, targetColl, idKey, ID)
+			return nil, txErr
+		})
+		if err != nil {
+			fmt.Println("db error fixing eval_value")
+			return fixed, err
+		}
+		if was == now { // an evaluation made since the first pass already made it right
+			continue
+		}
+		log.WithFields(log.Fields{
+			idKey: ID, "was": was, "now": now,
+		}).Info("Fixed eval_value")
+		fixed++
+	}
+	return fixed, nil
+}
+
+//recountEval - counts the evaluations of ID and writes the result to its eval_value, ctx carries the transaction
+func recountEval(ctx context.Context, evalColl *mongo.Collection, targetColl *mongo.Collection, idKey string, ID string) (int64, int64, error) {
+	var doc struct {
+		EvalValue int64 `bson:"eval_value"`
+	}
+	err := targetColl.FindOne(ctx, bson.M{idKey: ID}, options.FindOne().SetProjection(bson.M{"_id": 0, "eval_value": 1})).Decode(&doc)
+	if err == mongo.ErrNoDocuments { // deleted since the first pass
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	cursor, err := evalColl.Aggregate(ctx, []bson.M{
+		bson.M{"$match": bson.M{idKey: ID}},
+		bson.M{"$group": bson.M{"_id": nil, "value": evalSum()}},
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	var counts []struct {
+		Value int64 `bson:"value"`
+	}
+	if err = cursor.All(ctx, &counts); err != nil {
+		return 0, 0, err
+	}
+	var value int64
+	if len(counts) > 0 {
+		value = counts[0].Value
+	}
+	if value == doc.EvalValue {
+		return value, value, nil
+	}
+	_, err = targetColl.UpdateOne(ctx, bson.M{idKey: ID}, bson.M{"$set": bson.M{"eval_value": value}})
+	if err != nil {
+		return 0, 0, err
+	}
+	return doc.EvalValue, value, nil
+}
+
+//evalSum - $group accumulator of upvotes - downvotes
+func evalSum() bson.M {
+	return bson.M{"$sum": bson.M{"$cond": []interface{}{
+		bson.M{"$eq": []interface{}{"$eval", "upvote"}}, 1, -1,
+	}}}
+}
+
 //DBGetMsgEval - NOT USED
 func DBGetMsgEval(MID string, eval int) ([]primitive.M, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
@@ -288,26 +844,114 @@ func DBGetMsgEval(MID string, eval int) ([]primitive.M, error) {
 	if err = cursor.All(ctx, &res); err != nil {
 		return nil, err
 	}
-	return res, nil
+	return res, nil
+}
+
+/*DBGetUser - Returns user from UID
+*
+* Which fields are shown depends on who is asking, profiles.go chooses them
+ */
+func DBGetUser(UID string) (*User, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var u User
+	err := usersColl.FindOne(ctx, bson.M{"uid": UID}).Decode(&u)
+	if err != nil {
+		return nil, err
+		//log.Fatal(err) //should not be fatal
+	}
+
+	return &u, nil
+}
+
+//DBGetSettings - settings of the user, zero values are the defaults
+func DBGetSettings(UID string) (*UserSettings, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var u User
+	err := usersColl.FindOne(ctx, bson.M{"uid": UID}, options.FindOne().SetProjection(bson.M{"_id": 0, "settings": 1})).Decode(&u)
+	if err != nil {
+		fmt.Println(err)
+		return nil, err
+	}
+	return &u.Settings, nil
+}
+
+//DBUpdateSettings - sets the settings.* fields in set, forgetLocation also removes the stored location
+func DBUpdateSettings(UID string, set bson.M, forgetLocation bool) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	update := bson.M{"$set": set}
+	if forgetLocation {
+		update["$unset"] = bson.M{"location": ""}
+	}
+	_, err := usersColl.UpdateOne(ctx, bson.M{"uid": UID}, update)
+	if err != nil {
+		fmt.Println(err)
+	}
+	return err
+}
+
+//DBGetProfileBriefs - uid, username and image of each of the users
+func DBGetProfileBriefs(UIDs []string) ([]ProfileBrief, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	projection := bson.M{"_id": 0, "uid": 1, "username": 1, "image": 1}
+	cursor, err := usersColl.Find(ctx, bson.M{"uid": bson.M{"$in": UIDs}}, options.Find().SetProjection(projection))
+	if err != nil {
+		return nil, err
+	}
+	res := []ProfileBrief{}
+	if err = cursor.All(ctx, &res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+//DBTouchUser - records that the user was just seen, and the language of the emails the user gets
+func DBTouchUser(UID string, lang string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := usersColl.UpdateOne(ctx, bson.M{"uid": UID}, bson.M{"$set": bson.M{"last_access": time.Now().Unix(), "lang": lang}})
+	if err != nil {
+		fmt.Println(err)
+	}
+	return err
 }
 
-/*DBGetUser - Returns user from UID, check privacy
+/*DBGetKarma - sum of the eval_value of the messages and comments of the user
 *
-* Need to check if the profile being asked for is from the person himself or is from someone else, this changes which fields should be returned
-* incomplete
  */
-func DBGetUser(UID string) (*User, error) {
+func DBGetKarma(UID string) (int64, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	var u User
-	err := usersColl.FindOne(ctx, bson.M{"uid": UID}).Decode(&u)
-	if err != nil {
-		return nil, err
-		//log.Fatal(err) //should not be fatal
+	pipeline := []bson.M{
+		bson.M{"$match": bson.M{"uid": UID}},
+		bson.M{"$group": bson.M{"_id": nil, "karma": bson.M{"$sum": "$eval_value"}}},
 	}
-
-	return &u, nil
+	var karma int64
+	for _, coll := range []*mongo.Collection{messagesColl, commentsColl} {
+		cursor, err := coll.Aggregate(ctx, pipeline)
+		if err != nil {
+			return 0, err
+		}
+		var res []struct {
+			Karma int64 `bson:"karma"`
+		}
+		if err = cursor.All(ctx, &res); err != nil {
+			return 0, err
+		}
+		if len(res) > 0 {
+			karma += res[0].Karma
+		}
+	}
+	return karma, nil
 }
 
 /*
@@ -360,6 +1004,14 @@ func DBListFriend(UID string) ([]string, error) {
 
 }
 
+//DBCountFriends - number of friends of the user
+func DBCountFriends(UID string) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	return friendshipsColl.CountDocuments(ctx, bson.M{"$or": []bson.M{bson.M{"uid1": UID}, bson.M{"uid2": UID}}})
+}
+
 //DBSendRequest - ....
 func DBSendRequest(senderUID, receiverUID string) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
@@ -388,11 +1040,12 @@ func DBSendRequest(senderUID, receiverUID string) error {
 
 		}
 		//if there is a request in the opposite direction, accept their request
-		err := DBAcceptRequest(receiverUID, senderUID)
-		if err != nil {
-			return err
-		}
+		return DBAcceptRequest(receiverUID, senderUID)
+	}
 
+	// the receiver chooses who can send it requests
+	if err := checkFriendRequestPolicy(senderUID, receiverUID); err != nil {
+		return err
 	}
 
 	// if there is no request on the opposite direction, send one!
@@ -406,6 +1059,38 @@ func DBSendRequest(senderUID, receiverUID string) error {
 
 }
 
+/*checkFriendRequestPolicy - error if the friend requests setting of the receiver does not allow the sender
+*
+ */
+func checkFriendRequestPolicy(senderUID, receiverUID string) error {
+	settings, err := DBGetSettings(receiverUID)
+	if err != nil {
+		return err
+	}
+	switch settings.FriendRequests {
+	case "nobody":
+		return errors.New("User does not accept friend requests")
+	case "friends_of_friends":
+		senderFriends, err := DBListFriend(senderUID)
+		if err != nil {
+			return err
+		}
+		receiverFriends, err := DBListFriend(receiverUID)
+		if err != nil {
+			return err
+		}
+		for _, s := range senderFriends {
+			for _, r := range receiverFriends {
+				if s == r {
+					return nil
+				}
+			}
+		}
+		return errors.New("User only accepts friend requests from friends of friends")
+	}
+	return nil
+}
+
 //DBAcceptRequest - ... // this actually corresponds to AddFriend, since u are accepting requests
 func DBAcceptRequest(senderUID, receiverUID string) error {
 
@@ -472,11 +1157,50 @@ func DBListRequest(UID string) ([]primitive.M, error) {
 
 //DBCheckUserEval - check if user evaluated this message and how he did it
 func DBCheckUserEval(UID string, MID string) (string, error) {
+	return checkUserEvalIn(likesColl, "mid", MID, UID)
+}
+
+//DBCheckUserEvals - evaluations of the user on each of these messages in a single query, "empty" if none
+func DBCheckUserEvals(UID string, MIDs []string) (map[string]string, error) {
+	return checkUserEvalsIn(likesColl, "mid", MIDs, UID)
+}
+
+//checkUserEvalsIn - evaluations of UID on the documents with idKey in IDs, "empty" if none
+func checkUserEvalsIn(evalColl *mongo.Collection, idKey string, IDs []string, UID string) (map[string]string, error) {
+	evals := make(map[string]string, len(IDs))
+	if len(IDs) == 0 {
+		return evals, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	projection := bson.M{"_id": 0, idKey: 1, "eval": 1}
+	cursor, err := evalColl.Find(ctx, bson.M{"uid": UID, idKey: bson.M{"$in": IDs}}, options.Find().SetProjection(projection))
+	if err != nil {
+		return nil, err
+	}
+	var res []bson.M
+	if err = cursor.All(ctx, &res); err != nil {
+		return nil, err
+	}
+	for _, ID := range IDs {
+		evals[ID] = "empty" // no likes/dislikes
+	}
+	for _, el := range res {
+		ID, _ := el[idKey].(string)
+		eval, _ := el["eval"].(string)
+		evals[ID] = eval
+	}
+	return evals, nil
+}
+
+//checkUserEvalIn - evaluation of UID on the document with idKey ID, "empty" if none
+func checkUserEvalIn(evalColl *mongo.Collection, idKey string, ID string, UID string) (string, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 	var res bson.M
 	projection := bson.M{"_id": 0, "eval": 1} // which fields are returned?
-	err := likesColl.FindOne(ctx, bson.M{"mid": MID, "uid": UID}, options.FindOne().SetProjection(projection)).Decode(&res)
+	err := evalColl.FindOne(ctx, bson.M{idKey: ID, "uid": UID}, options.FindOne().SetProjection(projection)).Decode(&res)
 	if err != nil {
 		if err == mongo.ErrNoDocuments {
 			return "empty", nil // no likes/dislikes
@@ -512,10 +1236,358 @@ func DBUpdateUsername(UID string, newUsername string) error {
 	return nil
 }
 
+/*
+* From here on out DB comments functions
+*
+*
+ */
+
+//DBCreateComment - inserts the comment and updates the counters of its message and parent
+func DBCreateComment(c *Comment) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	session, err := Client.StartSession()
+	if err != nil {
+		return err
+	}
+	defer session.EndSession(ctx)
+
+	// in a transaction, so comment_count and reply_count always match the comments
+	_, err = session.WithTransaction(ctx, func(sc mongo.SessionContext) (interface{}, error) {
+		_, err := commentsColl.InsertOne(sc, c)
+		if err != nil {
+			fmt.Println("Failed to insert comment in DB")
+			return nil, err
+		}
+		_, err = messagesColl.UpdateOne(sc, bson.M{"mid": c.MID}, bson.M{"$inc": bson.M{"comment_count": 1}})
+		if err != nil {
+			fmt.Println("db error updating comment count")
+			return nil, err
+		}
+		if c.ParentCID != "" {
+			_, err = commentsColl.UpdateOne(sc, bson.M{"cid": c.ParentCID}, bson.M{"$inc": bson.M{"reply_count": 1}})
+			if err != nil {
+				fmt.Println("db error updating reply count")
+				return nil, err
+			}
+		}
+		return nil, nil
+	})
+	return err
+}
+
+//DBGetComment - returns the comment with this CID
+func DBGetComment(CID string) (*Comment, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var c Comment
+	err := commentsColl.FindOne(ctx, bson.M{"cid": CID}).Decode(&c)
+	if err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+//DBListComments - a page of the top level comments of a message, or of the replies to parentCID
+func DBListComments(MID string, parentCID string, page int64, limit int64) ([]Comment, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	filter := bson.M{"mid": MID, "parent_cid": bson.M{"$exists": false}}
+	if parentCID != "" {
+		filter = bson.M{"mid": MID, "parent_cid": parentCID}
+	}
+	opts := options.Find().SetProjection(bson.M{"_id": 0}).SetSort(bson.D{{Key: "date", Value: 1}, {Key: "cid", Value: 1}}).SetSkip(page * limit).SetLimit(limit)
+	cursor, err := commentsColl.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	res := []Comment{}
+	if err = cursor.All(ctx, &res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+//DBUpdateCommentEval - changes the number of likes/dislikes in a comment, same semantics as DBUpdateEval
+func DBUpdateCommentEval(CID string, UID string, eval string) error {
+	return updateEvalIn(commentLikesColl, commentsColl, "cid", CID, UID, eval)
+}
+
+//DBCheckUserCommentEvals - evaluations of the user on each of these comments, "empty" if none
+func DBCheckUserCommentEvals(UID string, CIDs []string) (map[string]string, error) {
+	return checkUserEvalsIn(commentLikesColl, "cid", CIDs, UID)
+}
+
+//deleteComments - deletes every comment of these messages and the evaluations of those comments, ctx can carry a transaction
+func deleteComments(ctx context.Context, MIDs []string) error {
+	CIDs, err := commentsColl.Distinct(ctx, "cid", bson.M{"mid": bson.M{"$in": MIDs}})
+	if err != nil {
+		return err
+	}
+	if len(CIDs) == 0 {
+		return nil
+	}
+	_, err = commentLikesColl.DeleteMany(ctx, bson.M{"cid": bson.M{"$in": CIDs}})
+	if err != nil {
+		fmt.Println("db error deleting evaluations of comments")
+		return err
+	}
+	_, err = commentsColl.DeleteMany(ctx, bson.M{"mid": bson.M{"$in": MIDs}})
+	if err != nil {
+		fmt.Println("db error deleting comments")
+		return err
+	}
+	return nil
+}
+
+/*
+* From here on out DB account deletion functions
+*
+ */
+
+//DBScheduleDeletion - saves the job, false if the user already has one
+func DBScheduleDeletion(job *DeletionJob) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	opts := options.Update().SetUpsert(true)
+	res, err := deletionsColl.UpdateOne(ctx, bson.M{"uid": job.UID}, bson.M{"$setOnInsert": job}, opts)
+	if err != nil {
+		fmt.Println(err)
+		return false, err
+	}
+	return res.UpsertedCount == 1, nil
+}
+
+//DBCancelDeletion - removes the job of the user if its grace period did not end, false if there is none
+func DBCancelDeletion(UID string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	res, err := deletionsColl.DeleteOne(ctx, bson.M{"uid": UID, "run_at": bson.M{"$gt": time.Now().Unix()}})
+	if err != nil {
+		fmt.Println(err)
+		return false, err
+	}
+	return res.DeletedCount == 1, nil
+}
+
+/*DBClaimDeletion - leases a job whose grace period ended and that nobody is running, nil if there is none
+*
+ */
+func DBClaimDeletion(now time.Time, lease time.Duration) (*DeletionJob, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	filter := bson.M{"run_at": bson.M{"$lte": now.Unix()}, "locked_until": bson.M{"$lt": now.Unix()}}
+	update := bson.M{"$set": bson.M{"locked_until": now.Add(lease).Unix()}}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	var job DeletionJob
+	err := deletionsColl.FindOneAndUpdate(ctx, filter, update, opts).Decode(&job)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+//DBUpdateDeletion - saves the progress of the job and extends its lease
+func DBUpdateDeletion(job *DeletionJob) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	update := bson.M{"$set": bson.M{
+		"step":         job.Step,
+		"vote_mids":    job.VoteMIDs,
+		"vote_cids":    job.VoteCIDs,
+		"locked_until": time.Now().Add(deletionJobLease).Unix(),
+	}}
+	_, err := deletionsColl.UpdateOne(ctx, bson.M{"uid": job.UID}, update)
+	if err != nil {
+		fmt.Println(err)
+	}
+	return err
+}
+
+//DBFinishDeletion - removes the job of an account that is gone
+func DBFinishDeletion(UID string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := deletionsColl.DeleteOne(ctx, bson.M{"uid": UID})
+	return err
+}
+
+//DBMarkUserDeleted - marks the user as being deleted, which DBGetHash treats as not existing
+func DBMarkUserDeleted(UID string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := usersColl.UpdateOne(ctx, bson.M{"uid": UID}, bson.M{"$set": bson.M{"deleted": true}})
+	return err
+}
+
+//DBGetUserVoteTargets - messages and comments the user evaluated
+func DBGetUserVoteTargets(UID string) ([]string, []string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var MIDs, CIDs []string
+	for _, t := range []struct {
+		coll  *mongo.Collection
+		idKey string
+		ids   *[]string
+	}{{likesColl, "mid", &MIDs}, {commentLikesColl, "cid", &CIDs}} {
+		values, err := t.coll.Distinct(ctx, t.idKey, bson.M{"uid": UID})
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, v := range values {
+			if ID, ok := v.(string); ok {
+				*t.ids = append(*t.ids, ID)
+			}
+		}
+	}
+	return MIDs, CIDs, nil
+}
+
+//DBDeleteUserVotes - deletes every evaluation of the user, eval_value must be fixed after
+func DBDeleteUserVotes(UID string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if _, err := likesColl.DeleteMany(ctx, bson.M{"uid": UID}); err != nil {
+		return err
+	}
+	_, err := commentLikesColl.DeleteMany(ctx, bson.M{"uid": UID})
+	return err
+}
+
+//DBGetUserMessages - mid, image and visibility of every message of the user
+func DBGetUserMessages(UID string) ([]Message, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	projection := bson.M{"_id": 0, "mid": 1, "image": 1, "visibility": 1}
+	cursor, err := messagesColl.Find(ctx, bson.M{"uid": UID}, options.Find().SetProjection(projection))
+	if err != nil {
+		return nil, err
+	}
+	var res []Message
+	if err = cursor.All(ctx, &res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+//DBAnonymizeMessages - removes the author and the image of the messages of the user
+func DBAnonymizeMessages(UID string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err := messagesColl.UpdateMany(ctx, bson.M{"uid": UID}, bson.M{"$set": bson.M{"uid": "", "image": ""}})
+	return err
+}
+
+//DBAnonymizeComments - removes the author of the comments of the user, and their text if blank
+func DBAnonymizeComments(UID string, blank bool) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	set := bson.M{"uid": ""}
+	if blank {
+		set["text"] = ""
+	}
+	_, err := commentsColl.UpdateMany(ctx, bson.M{"uid": UID}, bson.M{"$set": set})
+	return err
+}
+
+//DBDeleteUserFriends - deletes the friendships and friend requests of the user, in both directions
+func DBDeleteUserFriends(UID string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err := friendshipsColl.DeleteMany(ctx, bson.M{"$or": []bson.M{bson.M{"uid1": UID}, bson.M{"uid2": UID}}})
+	if err != nil {
+		return err
+	}
+	_, err = friendsReqsColl.DeleteMany(ctx, bson.M{"$or": []bson.M{bson.M{"sender_uid": UID}, bson.M{"receiver_uid": UID}}})
+	return err
+}
+
+//DBDeleteUser - deletes the user document
+func DBDeleteUser(UID string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := usersColl.DeleteOne(ctx, bson.M{"uid": UID})
+	return err
+}
+
 /*
 * AUX FUNCTIONS
  */
 
+//messagesFilter - filter of the visible messages matching geoFilter (if any), only from friends if group is "friends"
+func messagesFilter(geoFilter bson.M, UID string, group string) (bson.M, error) {
+	userFriends, err := DBListFriend(UID)
+	if err != nil {
+		fmt.Printf("error listing friends")
+		return nil, err
+	}
+	if userFriends == nil {
+		userFriends = []string{} // $in needs an array
+	}
+	// messages only for friends are seen by the friends and the author
+	visible := []bson.M{
+		bson.M{"visibility": bson.M{"$ne": "friends"}},
+		bson.M{"uid": UID},
+		bson.M{"uid": bson.M{"$in": userFriends}},
+	}
+	filter := bson.M{"$and": []bson.M{bson.M{"$or": notExpired()}, bson.M{"$or": visible}}}
+	if geoFilter != nil {
+		filter["location"] = geoFilter
+	}
+	if group == "friends" { // if group is friends change filter to also consider friend list
+		filter["uid"] = bson.M{"$in": userFriends}
+	}
+	return filter, nil
+}
+
+/*hotScore - expression of the hot ranking of a message at the time now
+* (eval_value + 1) / (age in hours + 2)^HotGravity, divided by (1 + distance_m / HotDistanceScale) when there is a distance
+ */
+func hotScore(now int64, withDistance bool) bson.M {
+	age := bson.M{"$max": []interface{}{
+		bson.M{"$divide": []interface{}{bson.M{"$subtract": []interface{}{now, "$date"}}, 3600}},
+		0,
+	}}
+	score := bson.M{"$divide": []interface{}{
+		bson.M{"$add": []interface{}{"$eval_value", 1}},
+		bson.M{"$pow": []interface{}{bson.M{"$add": []interface{}{age, 2}}, config.HotGravity}},
+	}}
+	if withDistance {
+		score = bson.M{"$divide": []interface{}{
+			score,
+			bson.M{"$add": []interface{}{1, bson.M{"$divide": []interface{}{"$distance_m", config.HotDistanceScale}}}},
+		}}
+	}
+	return score
+}
+
+//notExpired - $or clause matching messages without expires_at or not expired yet
+func notExpired() []bson.M {
+	return []bson.M{
+		bson.M{"expires_at": bson.M{"$exists": false}},
+		bson.M{"expires_at": bson.M{"$gt": time.Now().Unix()}},
+	}
+}
+
 func checkUserExists(UID string) (bool, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
@@ -531,6 +1603,25 @@ func checkUserExists(UID string) (bool, error) {
 	return true, nil
 }
 
+//createEvalIndexes - one evaluation per user and message/comment, so a double tap can't insert two
+func createEvalIndexes() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err := likesColl.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "mid", Value: 1}, {Key: "uid", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = commentLikesColl.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "cid", Value: 1}, {Key: "uid", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	return err
+}
+
 //unused, just to create index
 func createIndex() error {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
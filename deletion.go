@@ -0,0 +1,300 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/mongo"
+	"golang.org/x/crypto/bcrypt"
+)
+
+/*DeletionJob - scheduled deletion of an account, saved in deletionsColl
+* Runs after the grace period, one step at a time. Step is the next one to run, so a job that was interrupted resumes where it stopped
+ */
+type DeletionJob struct {
+	UID         string   `json:"-" bson:"uid"`
+	Email       string   `json:"-" bson:"email"` // told when the account is gone
+	Lang        string   `json:"-" bson:"lang"`
+	Messages    string   `json:"messages" bson:"messages"` // delete or anonymize
+	RequestedAt int64    `json:"requested_at" bson:"requested_at"`
+	RunAt       int64    `json:"run_at" bson:"run_at"`
+	Step        int      `json:"-" bson:"step"`
+	LockedUntil int64    `json:"-" bson:"locked_until"`
+	VoteMIDs    []string `json:"-" bson:"vote_mids,omitempty"` // messages and comments whose eval_value must be fixed
+	VoteCIDs    []string `json:"-" bson:"vote_cids,omitempty"`
+}
+
+//DeleteAccount - body of DELETE /users/me
+type DeleteAccount struct {
+	Password string `json:"password" validate:"required"`
+	Messages string `json:"messages" validate:"required,oneof=delete anonymize"`
+}
+
+const (
+	accountDeletionGrace = 7 * 24 * time.Hour
+	deletionJobLease     = 10 * time.Minute // a job that was not finished by then is picked up again
+)
+
+//deletionSteps - what deleting an account does, in order. Every step can run again without harm
+var deletionSteps = []struct {
+	name string
+	run  func(job *DeletionJob) error
+}{
+	{"lock out", deleteStepLockOut},
+	{"votes", deleteStepVotes},
+	{"messages", deleteStepMessages},
+	{"comments", deleteStepComments},
+	{"friends", deleteStepFriends},
+	{"profile image", deleteStepImage},
+	{"user", deleteStepUser},
+	{"notify", deleteStepNotify},
+}
+
+/*userDeleteAccount - schedules the deletion of the logged in user, which needs the password
+* Until the grace period ends the user can log in and cancel it
+ */
+func userDeleteAccount(req *http.Request) Response {
+	tokenAuth, err := ExtractTokenMetadata(req)
+	if err != nil {
+		return Response{Error: true, Msg: err.Error()}
+	}
+	var data DeleteAccount
+	decoder := json.NewDecoder(req.Body)
+	if err = decoder.Decode(&data); err != nil {
+		return Response{Error: true, Msg: "Invalid request"}
+	}
+	if !_validateInput(data) {
+		return Response{Error: true, Msg: "Send the password and whether to delete or anonymize the messages"}
+	}
+	u, err := DBGetUser(tokenAuth.UID)
+	if err != nil {
+		return Response{Error: true, Msg: "DB Error"}
+	}
+	if bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(data.Password)) != nil {
+		return Response{Error: true, Msg: "Password is wrong"}
+	}
+
+	now := time.Now()
+	job := DeletionJob{
+		UID:         u.UID,
+		Email:       u.Email,
+		Lang:        requestLanguage(req),
+		Messages:    data.Messages,
+		RequestedAt: now.Unix(),
+		RunAt:       now.Add(accountDeletionGrace).Unix(),
+	}
+	scheduled, err := DBScheduleDeletion(&job)
+	if err != nil {
+		return Response{Error: true, Msg: "DB Error"}
+	}
+	if !scheduled {
+		return Response{Error: true, Msg: "The account is already scheduled for deletion"}
+	}
+	log.WithFields(log.Fields{
+		"uid": u.UID, "run_at": job.RunAt,
+	}).Info("Account deletion scheduled")
+
+	notice := map[string]string{"Date": time.Unix(job.RunAt, 0).UTC().Format("2006-01-02 15:04 MST")}
+	if err = sendEmail(u.Email, "deletion_scheduled", job.Lang, notice); err != nil {
+		fmt.Println("failed to send deletion email:", err)
+	}
+	jobJSON, err := json.Marshal(job)
+	if err != nil {
+		return Response{Error: true, Msg: "error processing information"}
+	}
+	return Response{Error: false, Msg: "Account scheduled for deletion", Data: jobJSON}
+}
+
+/*userCancelDeletion - cancels the deletion of the logged in user, if it did not start yet
+*
+ */
+func userCancelDeletion(req *http.Request) Response {
+	tokenAuth, err := ExtractTokenMetadata(req)
+	if err != nil {
+		return Response{Error: true, Msg: err.Error()}
+	}
+	canceled, err := DBCancelDeletion(tokenAuth.UID)
+	if err != nil {
+		return Response{Error: true, Msg: "DB Error"}
+	}
+	if !canceled {
+		return Response{Error: true, Msg: "There is no deletion to cancel"}
+	}
+	log.WithFields(log.Fields{
+		"uid": tokenAuth.UID,
+	}).Info("Account deletion canceled")
+	return Response{Error: false, Msg: "Account deletion canceled"}
+}
+
+/*runAccountDeletions - every interval runs the deletions whose grace period ended
+* Run as a goroutine. Jobs are leased, so several servers can run this at the same time
+ */
+func runAccountDeletions(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		for {
+			job, err := DBClaimDeletion(time.Now(), deletionJobLease)
+			if err != nil {
+				log.WithFields(log.Fields{
+					"request": "runAccountDeletions",
+				}).Info(err)
+				break
+			}
+			if job == nil {
+				break
+			}
+			if err = runDeletion(job); err != nil {
+				log.WithFields(log.Fields{
+					"uid": job.UID, "step": job.Step,
+				}).Info("Account deletion failed, will resume: ", err)
+				break
+			}
+		}
+	}
+}
+
+/*runDeletion - runs the steps of the job from the one it stopped at
+* The progress is saved after every step, the last one too, so a job claimed again after a failure never repeats a finished step
+ */
+func runDeletion(job *DeletionJob) error {
+	for job.Step < len(deletionSteps) {
+		step := deletionSteps[job.Step]
+		if err := step.run(job); err != nil {
+			return fmt.Errorf("%s: %v", step.name, err)
+		}
+		job.Step++
+		if err := DBUpdateDeletion(job); err != nil {
+			return err
+		}
+	}
+	log.WithFields(log.Fields{
+		"uid": job.UID,
+	}).Info("Account deleted")
+	return DBFinishDeletion(job.UID)
+}
+
+//deleteStepLockOut - no more logins of any kind, and every session ends
+func deleteStepLockOut(job *DeletionJob) error {
+	if err := DBMarkUserDeleted(job.UID); err != nil {
+		return err
+	}
+	return RevokeAllTokens(job.UID)
+}
+
+/*deleteStepVotes - removes the evaluations of the user and fixes eval_value of what was evaluated
+* The evaluated IDs are saved in the job first, so they are still fixed if the step is interrupted after deleting
+ */
+func deleteStepVotes(job *DeletionJob) error {
+	MIDs, CIDs, err := DBGetUserVoteTargets(job.UID)
+	if err != nil {
+		return err
+	}
+	job.VoteMIDs = appendMissing(job.VoteMIDs, MIDs)
+	job.VoteCIDs = appendMissing(job.VoteCIDs, CIDs)
+	if err = DBUpdateDeletion(job); err != nil {
+		return err
+	}
+	if err = DBDeleteUserVotes(job.UID); err != nil {
+		return err
+	}
+	// with no IDs these would fix every message
+	if len(job.VoteMIDs) > 0 {
+		if _, err = DBReconcileEvals(job.VoteMIDs); err != nil {
+			return err
+		}
+	}
+	if len(job.VoteCIDs) > 0 {
+		if _, err = DBReconcileCommentEvals(job.VoteCIDs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*deleteStepMessages - deletes or anonymizes the messages of the user
+* Messages only for friends are always deleted, anonymous they could not be seen by anyone.
+* Anonymized messages lose their image, which could show who wrote them
+ */
+func deleteStepMessages(job *DeletionJob) error {
+	msgs, err := DBGetUserMessages(job.UID)
+	if err != nil {
+		return err
+	}
+	for _, msg := range msgs {
+		// the image goes first, a message left behind is found again when the step resumes
+		if msg.Image != "" {
+			if err := deleteImage(msg.Image); err != nil {
+				return err
+			}
+		}
+		if job.Messages == "anonymize" && msg.Visibility != "friends" {
+			continue
+		}
+		// DBDeleteMessage deletes everything or nothing, so ErrNoDocuments means someone else already deleted it all
+		if err := DBDeleteMessage(msg.MID, job.UID); err != nil && err != mongo.ErrNoDocuments {
+			return err
+		}
+	}
+	if job.Messages == "anonymize" {
+		return DBAnonymizeMessages(job.UID)
+	}
+	return nil
+}
+
+//deleteStepComments - comments stay so the threads make sense, without author and, if deleting, without text
+func deleteStepComments(job *DeletionJob) error {
+	return DBAnonymizeComments(job.UID, job.Messages == "delete")
+}
+
+//deleteStepFriends - removes the friendships and friend requests of the user
+func deleteStepFriends(job *DeletionJob) error {
+	return DBDeleteUserFriends(job.UID)
+}
+
+//deleteStepImage - deletes the profile image, the user points to it until it is gone so a failure is retried
+func deleteStepImage(job *DeletionJob) error {
+	u, err := DBGetUser(job.UID)
+	if err != nil {
+		return err
+	}
+	if u.Image == "" {
+		return nil
+	}
+	if err = deleteImage(u.Image); err != nil {
+		return err
+	}
+	_, err = DBUpdateUserImage(job.UID, "")
+	return err
+}
+
+//deleteStepUser - deletes the user document, with its settings and 2FA secrets
+func deleteStepUser(job *DeletionJob) error {
+	return DBDeleteUser(job.UID)
+}
+
+//deleteStepNotify - tells the user the account is gone
+func deleteStepNotify(job *DeletionJob) error {
+	if err := sendEmail(job.Email, "account_deleted", job.Lang, nil); err != nil {
+		fmt.Println("failed to send deletion email:", err)
+	}
+	return nil
+}
+
+//appendMissing - a with the elements of b it does not have yet
+func appendMissing(a []string, b []string) []string {
+	seen := make(map[string]bool, len(a))
+	for _, s := range a {
+		seen[s] = true
+	}
+	for _, s := range b {
+		if !seen[s] {
+			a = append(a, s)
+			seen[s] = true
+		}
+	}
+	return a
+}
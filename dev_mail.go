@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/segmentio/ksuid"
+	log "github.com/sirupsen/logrus"
+)
+
+//DevMailer - Mailer that sends nothing, emails are written as .eml files to Dir or to the log if there is no Dir
+type DevMailer struct {
+	Dir  string
+	from string
+}
+
+//NewDevMailer - ...
+func NewDevMailer(c MailConfig) *DevMailer {
+	if c.DevDir != "" {
+		if err := os.MkdirAll(c.DevDir, 0755); err != nil {
+			log.Fatal(err)
+		}
+	}
+	return &DevMailer{Dir: c.DevDir, from: c.From}
+}
+
+//Send - ...
+func (m *DevMailer) Send(ctx context.Context, e *Email) error {
+	if m.Dir == "" {
+		log.WithFields(log.Fields{
+			"to": e.To, "subject": e.Subject, "text": e.Text,
+		}).Info("Email not sent (dev mailer)")
+		return nil
+	}
+	msg, err := buildMIME(m.from, e)
+	if err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%s-%s.eml", time.Now().Format("20060102-150405"), ksuid.New().String())
+	return ioutil.WriteFile(filepath.Join(m.Dir, name), msg, 0644)
+}
@@ -2,9 +2,11 @@ package main
 
 import (
 	"encoding/json"
+	"flag"
 	"fmt"
 	"net/http"
 	"os"
+	"time"
 
 	"github.com/gorilla/mux"
 	log "github.com/sirupsen/logrus"
@@ -20,6 +22,7 @@ type Request struct {
 type Response struct {
 	Error bool            `json:"error" bson:"error"`
 	Msg   string          `json:"msg,omitempty" bson:"msg"`
+	Code  string          `json:"code,omitempty" bson:"code"` // machine readable reason of some errors, like "unverified"
 	Data  json.RawMessage `json:"data,omitempty" bson:"data"`
 }
 
@@ -100,6 +103,51 @@ func createMsgEP(w http.ResponseWriter, req *http.Request) {
 
 }
 
+/*editMsg - handler for editing message requests
+*
+ */
+func editMsgEP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	res := editMsg(req)
+	json.NewEncoder(w).Encode(res)
+}
+
+/*deleteMsg - handler for deleting message requests
+*
+ */
+func deleteMsgEP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	res := deleteMsg(req)
+	json.NewEncoder(w).Encode(res)
+}
+
+/*createComment - handler for commenting on a message
+*
+ */
+func createCommentEP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	res := createComment(req)
+	json.NewEncoder(w).Encode(res)
+}
+
+/*listComments - handler for listing the comments of a message
+*
+ */
+func listCommentsEP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	res := listComments(req)
+	json.NewEncoder(w).Encode(res)
+}
+
+/*updateCommentEval - handler to update the likes/dislikes of a comment
+*
+ */
+func updateCommentEvalEP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	res := updateCommentEval(req)
+	json.NewEncoder(w).Encode(res)
+}
+
 /*reqMsgZone - handler for requests to all the messages in a zone
 *
  */
@@ -110,6 +158,33 @@ func reqMsgZoneEP(w http.ResponseWriter, req *http.Request) {
 
 }
 
+/*reqMsgWithin - handler for requests to all the messages in the visible area of the map
+*
+ */
+func reqMsgWithinEP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	res := reqMsgWithin(req)
+	json.NewEncoder(w).Encode(res)
+}
+
+/*reqMsgClusters - handler for requests to the clusters of messages in the visible area of the map
+*
+ */
+func reqMsgClustersEP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	res := reqMsgClusters(req)
+	json.NewEncoder(w).Encode(res)
+}
+
+/*getMsgHistory - handler for requests to the previous versions of a message
+*
+ */
+func getMsgHistoryEP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	res := getMsgHistory(req)
+	json.NewEncoder(w).Encode(res)
+}
+
 /*UpdateLikes - handler to udpate the number of likes/dislikes in a message
 *
  */
@@ -181,6 +256,141 @@ func userValidateEP(w http.ResponseWriter, req *http.Request) {
 	json.NewEncoder(w).Encode(res)
 }
 
+func userForgotPasswordEP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	res := userForgotPassword(req)
+	json.NewEncoder(w).Encode(res)
+}
+
+func userResetPasswordEP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	res := userResetPassword(req)
+	json.NewEncoder(w).Encode(res)
+}
+
+func userChangePasswordEP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	res := userChangePassword(req)
+	json.NewEncoder(w).Encode(res)
+}
+
+func userChangeEmailEP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	res := userChangeEmail(req)
+	json.NewEncoder(w).Encode(res)
+}
+
+func userConfirmEmailEP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	res := userConfirmEmail(req)
+	json.NewEncoder(w).Encode(res)
+}
+
+func userListSessionsEP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	res := userListSessions(req)
+	json.NewEncoder(w).Encode(res)
+}
+
+func userRevokeSessionEP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	res := userRevokeSession(req)
+	json.NewEncoder(w).Encode(res)
+}
+
+func userLogoutAllEP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	res := userLogoutAll(req)
+	json.NewEncoder(w).Encode(res)
+}
+
+func userEnrollTOTPEP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	res := userEnrollTOTP(req)
+	json.NewEncoder(w).Encode(res)
+}
+
+func userVerifyTOTPEP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	res := userVerifyTOTP(req)
+	json.NewEncoder(w).Encode(res)
+}
+
+func userDisableTOTPEP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	res := userDisableTOTP(req)
+	json.NewEncoder(w).Encode(res)
+}
+
+func userLoginMFAEP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	res := userLoginMFA(req)
+	json.NewEncoder(w).Encode(res)
+}
+
+func userMagicLoginEP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	res := userMagicLogin(req)
+	json.NewEncoder(w).Encode(res)
+}
+
+func userMagicVerifyEP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	res := userMagicVerify(req)
+	json.NewEncoder(w).Encode(res)
+}
+
+func userResendValidationEP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	res := userResendValidation(req)
+	json.NewEncoder(w).Encode(res)
+}
+
+func userGetMeEP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	res := userGetMe(req)
+	json.NewEncoder(w).Encode(res)
+}
+
+func userGetProfileEP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	res := userGetProfile(req)
+	json.NewEncoder(w).Encode(res)
+}
+
+func userGetSettingsEP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	res := userGetSettings(req)
+	json.NewEncoder(w).Encode(res)
+}
+
+func userPatchSettingsEP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	res := userPatchSettings(req)
+	json.NewEncoder(w).Encode(res)
+}
+
+func userDeleteAccountEP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	res := userDeleteAccount(req)
+	json.NewEncoder(w).Encode(res)
+}
+
+func userCancelDeletionEP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	res := userCancelDeletion(req)
+	json.NewEncoder(w).Encode(res)
+}
+
+/*jwksEP - publishes the public keys so other services can verify our tokens
+* Answers with a plain JWK Set, not a Response, since that is what JWT libraries expect
+ */
+func jwksEP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	json.NewEncoder(w).Encode(map[string][]JWK{"keys": keyring.JWKS()})
+}
+
 /*main - main is main
 *
  */
@@ -198,21 +408,61 @@ func main() {
 	log.SetFormatter(&log.JSONFormatter{}) // &log.TextFormatter
 	log.SetLevel(log.InfoLevel)
 
+	// admin routines, run instead of the server
+	reconcile := flag.String("reconcile-evals", "", "recompute eval_value from the evaluations for these MIDs (comma separated) or \"all\", then exit")
+	flag.Parse()
+	if *reconcile != "" {
+		if err := reconcileEvals(*reconcile); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if err := createEvalIndexes(); err != nil {
+		log.WithFields(log.Fields{
+			"request": "createEvalIndexes",
+		}).Info(err)
+	}
+
 	// TODO - change names to: users, logins logouts pings refreshes signups lists removes accepts refuses sends ? also change createMsg reqMsgZone?
 	router := mux.NewRouter().StrictSlash(true)
 	router.HandleFunc("/", root)
 	//change latitude and longitude to query parameters
-	router.HandleFunc("/messages/near", reqMsgZoneEP).Queries("latitude", "", "longitude", "", "order", "{order:new|best}", "group", "{group:all|friends}").Methods("GET")
+	router.HandleFunc("/messages/near", reqMsgZoneEP).Queries("latitude", "", "longitude", "", "order", "{order:new|best|hot|near}", "group", "{group:all|friends}").Methods("GET")
+	router.HandleFunc("/messages/within", reqMsgWithinEP).Queries("order", "{order:new|best|hot}", "group", "{group:all|friends}").Methods("GET")
+	router.HandleFunc("/messages/clusters", reqMsgClustersEP).Queries("bbox", "", "zoom", "{zoom:[0-9]+}", "group", "{group:all|friends}").Methods("GET")
 	router.HandleFunc("/messages/post", createMsgEP).Methods("POST")
 	// TODO , change eval to query parameters. Also change any headers used to query
 	router.HandleFunc("/messages/{MID}", updateEvalEP).Queries("eval", "{eval:upvote|downvote}").Methods("POST") //this one posts a like // eval can be upvote or downvote
+	router.HandleFunc("/messages/{MID}", editMsgEP).Methods("PUT")
+	router.HandleFunc("/messages/{MID}", deleteMsgEP).Methods("DELETE")
+	router.HandleFunc("/messages/{MID}/history", getMsgHistoryEP).Methods("GET")
+	router.HandleFunc("/messages/{MID}/comments", createCommentEP).Methods("POST")
+	router.HandleFunc("/messages/{MID}/comments", listCommentsEP).Methods("GET")
+	router.HandleFunc("/messages/{MID}/comments/{CID}", updateCommentEvalEP).Queries("eval", "{eval:upvote|downvote}").Methods("POST")
 	//not being used
 	//router.HandleFunc("/messages/{MID}/{eval}", getEvalEP).Methods("GET")     // this one gets the likes
+	router.HandleFunc("/.well-known/jwks.json", jwksEP).Methods("GET")
 	router.HandleFunc("/users/login", userLoginEP).Methods("POST")
+	router.HandleFunc("/users/login/2fa", userLoginMFAEP).Methods("POST")
+	router.HandleFunc("/users/login/magic", userMagicLoginEP).Methods("POST")
+	router.HandleFunc("/users/login/magic/verify", userMagicVerifyEP).Methods("POST")
 	router.HandleFunc("/users/logout", userLogoutEP).Methods("GET")
+	router.HandleFunc("/users/logout/all", userLogoutAllEP).Methods("GET")
+	router.HandleFunc("/users/sessions", userListSessionsEP).Methods("GET")
+	router.HandleFunc("/users/sessions/{id}", userRevokeSessionEP).Methods("DELETE")
+	router.HandleFunc("/users/2fa/enroll", userEnrollTOTPEP).Methods("POST")
+	router.HandleFunc("/users/2fa/verify", userVerifyTOTPEP).Methods("POST")
+	router.HandleFunc("/users/2fa/disable", userDisableTOTPEP).Methods("POST")
 	router.HandleFunc("/users/ping", userPingEP).Methods("GET")
 	router.HandleFunc("/users/signup", userSignupEP).Methods("POST")
 	router.HandleFunc("/users/validate", userValidateEP).Queries("code", "").Methods("GET")
+	router.HandleFunc("/users/validate/resend", userResendValidationEP).Methods("POST")
+	router.HandleFunc("/users/password/forgot", userForgotPasswordEP).Methods("POST")
+	router.HandleFunc("/users/password/reset", userResetPasswordEP).Methods("POST")
+	router.HandleFunc("/users/password", userChangePasswordEP).Methods("POST")
+	router.HandleFunc("/users/email", userChangeEmailEP).Methods("POST")
+	router.HandleFunc("/users/email/confirm", userConfirmEmailEP).Queries("code", "").Methods("GET")
 	router.HandleFunc("/users/location", userLocationEP).Methods("POST")
 	router.HandleFunc("/users/token/refresh", userRefreshTokenEP).Methods("GET")
 	router.HandleFunc("/users/friends/remove/{UID}", userRemoveFriendEP).Methods("POST")
@@ -222,7 +472,20 @@ func main() {
 	router.HandleFunc("/users/friends/request/refuse/{UID}", userRefuseRequestEP).Methods("POST")
 	router.HandleFunc("/users/friends/request/list", userListRequestEP).Methods("GET")
 	router.HandleFunc("/users/images/post", userImagesEP).Methods("POST")
-	fmt.Println("Server running on port 8080")
+	router.HandleFunc("/users/me", userGetMeEP).Methods("GET")
+	router.HandleFunc("/users/me", userDeleteAccountEP).Methods("DELETE")
+	router.HandleFunc("/users/me/deletion", userCancelDeletionEP).Methods("DELETE")
+	router.HandleFunc("/users/me/settings", userGetSettingsEP).Methods("GET")
+	router.HandleFunc("/users/me/settings", userPatchSettingsEP).Methods("PATCH")
+	router.HandleFunc("/users/{UID:u[0-9A-Za-z]{27}}", userGetProfileEP).Methods("GET") // after every other /users/ route
+	if config.Storage.Backend == "local" {                                              // images are served by us
+		router.PathPrefix("/images/").Handler(http.StripPrefix("/images/", http.FileServer(http.Dir(config.Storage.LocalDir)))).Methods("GET")
+	}
+	go sweepExpiredMessages(time.Minute)
+	go runAccountDeletions(time.Minute)
+	go keyring.rotateKeys(time.Hour)
+
+	fmt.Println("Server running on", config.ListenAddr)
 
-	log.Fatal(http.ListenAndServe(":8080", router))
+	log.Fatal(http.ListenAndServe(config.ListenAddr, router))
 }
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/segmentio/ksuid"
+	log "github.com/sirupsen/logrus"
+)
+
+/*SigningKey - a key that signs tokens
+* The kid is a ksuid, so it also tells when the key was made
+ */
+type SigningKey struct {
+	Kid     string
+	Created time.Time
+	Method  jwt.SigningMethod
+	Private interface{} // *rsa.PrivateKey or ed25519.PrivateKey
+	Public  interface{} // *rsa.PublicKey or ed25519.PublicKey
+}
+
+/*Keyring - the signing keys, saved as <kid>.pem files in config.Keys.Dir
+* The newest key of the configured algorithm signs, older keys only verify until every token they signed expired
+ */
+type Keyring struct {
+	mu       sync.RWMutex
+	conf     KeysConfig
+	keys     map[string]*SigningKey
+	current  *SigningKey
+	lastLoad time.Time
+}
+
+//JWK - public key in the JSON Web Key format
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+}
+
+//how often a kid that is not known makes us look for new keys, made by other servers sharing the dir
+const keysReloadInterval = 10 * time.Second
+
+var keyring = NewKeyring(config.Keys)
+
+/*NewKeyring - loads the keys in c.Dir, making a new one if there is none to sign with
+*
+ */
+func NewKeyring(c KeysConfig) *Keyring {
+	k := &Keyring{conf: c}
+	if err := os.MkdirAll(c.Dir, 0700); err != nil {
+		log.Fatal("keys: ", err)
+	}
+	if err := k.rotate(); err != nil {
+		log.Fatal("keys: ", err)
+	}
+	return k
+}
+
+/*rotateKeys - checks every interval if the signing key is due for rotation
+* Run as a goroutine
+ */
+func (k *Keyring) rotateKeys(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := k.rotate(); err != nil {
+			fmt.Println("failed to rotate signing keys:", err)
+		}
+	}
+}
+
+/*rotate - makes a new signing key when the current one is older than conf.Rotation and removes the keys no token can need
+* A key signs for at most conf.Rotation and its tokens live at most config.RefreshLifetime
+ */
+func (k *Keyring) rotate() error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if err := k.load(); err != nil {
+		return err
+	}
+	if k.current == nil || time.Since(k.current.Created) >= k.conf.Rotation {
+		key, err := k.generate()
+		if err != nil {
+			return err
+		}
+		k.keys[key.Kid] = key
+		k.current = key
+		log.WithFields(log.Fields{
+			"kid": key.Kid, "alg": key.Method.Alg(),
+		}).Info("New signing key")
+	}
+
+	retention := k.conf.Rotation + config.RefreshLifetime
+	for kid, key := range k.keys {
+		if key != k.current && time.Since(key.Created) > retention {
+			if err := os.Remove(filepath.Join(k.conf.Dir, kid+".pem")); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			delete(k.keys, kid)
+		}
+	}
+	return nil
+}
+
+/*load - reads every key in the dir, holding the write lock
+*
+ */
+func (k *Keyring) load() error {
+	files, err := ioutil.ReadDir(k.conf.Dir)
+	if err != nil {
+		return err
+	}
+	keys := map[string]*SigningKey{}
+	var current *SigningKey
+	for _, f := range files {
+		if f.IsDir() || filepath.Ext(f.Name()) != ".pem" {
+			continue
+		}
+		key, err := k.readKey(f.Name())
+		if err != nil {
+			log.WithFields(log.Fields{
+				"file": f.Name(),
+			}).Warn("Ignoring signing key: ", err)
+			continue
+		}
+		keys[key.Kid] = key
+		if key.Method.Alg() == k.conf.Algorithm && (current == nil || key.Created.After(current.Created)) {
+			current = key
+		}
+	}
+	k.keys = keys
+	k.current = current
+	k.lastLoad = time.Now()
+	return nil
+}
+
+func (k *Keyring) readKey(name string) (*SigningKey, error) {
+	kid := strings.TrimSuffix(name, ".pem")
+	id, err := ksuid.Parse(kid)
+	if err != nil {
+		return nil, errors.New("file name is not a kid")
+	}
+	data, err := ioutil.ReadFile(filepath.Join(k.conf.Dir, name))
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("not a PEM file")
+	}
+	private, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	return newSigningKey(kid, id.Time(), private)
+}
+
+/*generate - makes a key of the configured algorithm and saves it to the dir
+*
+ */
+func (k *Keyring) generate() (*SigningKey, error) {
+	var private interface{}
+	var err error
+	switch k.conf.Algorithm {
+	case "RS256":
+		private, err = rsa.GenerateKey(rand.Reader, 2048)
+	case "EdDSA":
+		_, private, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		err = fmt.Errorf("unknown signing algorithm %q", k.conf.Algorithm)
+	}
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return nil, err
+	}
+
+	id := ksuid.New()
+	// write then rename, so other servers never read half a key
+	path := filepath.Join(k.conf.Dir, id.String()+".pem")
+	tmp := path + ".tmp"
+	if err = ioutil.WriteFile(tmp, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		return nil, err
+	}
+	if err = os.Rename(tmp, path); err != nil {
+		return nil, err
+	}
+	return newSigningKey(id.String(), id.Time(), private)
+}
+
+func newSigningKey(kid string, created time.Time, private interface{}) (*SigningKey, error) {
+	key := &SigningKey{Kid: kid, Created: created, Private: private}
+	switch p := private.(type) {
+	case *rsa.PrivateKey:
+		key.Method = jwt.SigningMethodRS256
+		key.Public = &p.PublicKey
+	case ed25519.PrivateKey:
+		key.Method = jwt.SigningMethodEdDSA
+		key.Public = p.Public()
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", private)
+	}
+	return key, nil
+}
+
+/*Sign - signs the claims with the current key, naming it in the kid header
+*
+ */
+func (k *Keyring) Sign(claims jwt.Claims) (string, error) {
+	k.mu.RLock()
+	key := k.current
+	k.mu.RUnlock()
+
+	token := jwt.NewWithClaims(key.Method, claims)
+	token.Header["kid"] = key.Kid
+	return token.SignedString(key.Private)
+}
+
+/*Keyfunc - picks the key that verifies token by its kid, for jwt.Parse
+* Keys made by other servers since the last load are looked for before giving up
+ */
+func (k *Keyring) Keyfunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	key := k.find(kid)
+	if key == nil {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	if token.Method.Alg() != key.Method.Alg() {
+		return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+	}
+	return key.Public, nil
+}
+
+func (k *Keyring) find(kid string) *SigningKey {
+	k.mu.RLock()
+	key, ok := k.keys[kid]
+	stale := time.Since(k.lastLoad) > keysReloadInterval
+	k.mu.RUnlock()
+	if ok || kid == "" || !stale {
+		return key
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if time.Since(k.lastLoad) > keysReloadInterval { // someone else may have just reloaded
+		current := k.current
+		if err := k.load(); err != nil {
+			fmt.Println("failed to reload signing keys:", err)
+		}
+		if k.current == nil { // keep signing, rotate makes a new key if it was deleted
+			k.current = current
+		}
+	}
+	return k.keys[kid]
+}
+
+/*JWKS - the public keys, in the format of /.well-known/jwks.json
+*
+ */
+func (k *Keyring) JWKS() []JWK {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	enc := base64.RawURLEncoding
+	jwks := []JWK{}
+	for _, key := range k.keys {
+		jwk := JWK{Kid: key.Kid, Use: "sig", Alg: key.Method.Alg()}
+		switch p := key.Public.(type) {
+		case *rsa.PublicKey:
+			jwk.Kty = "RSA"
+			jwk.N = enc.EncodeToString(p.N.Bytes())
+			jwk.E = enc.EncodeToString(big.NewInt(int64(p.E)).Bytes())
+		case ed25519.PublicKey:
+			jwk.Kty = "OKP"
+			jwk.Crv = "Ed25519"
+			jwk.X = enc.EncodeToString(p)
+		}
+		jwks = append(jwks, jwk)
+	}
+	return jwks
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+//LocalStore - BlobStore in a directory of the server, served under /images/
+type LocalStore struct {
+	dir     string
+	baseURL string
+}
+
+//NewLocalStore - store in the configured directory, created if it does not exist
+func NewLocalStore(c StorageConfig) (*LocalStore, error) {
+	if err := os.MkdirAll(c.LocalDir, 0755); err != nil {
+		return nil, err
+	}
+	return &LocalStore{dir: c.LocalDir, baseURL: config.PublicURL + "/images/"}, nil
+}
+
+//path - file of the blob, names can't leave the directory
+func (s *LocalStore) path(name string) string {
+	return filepath.Join(s.dir, filepath.Base(name))
+}
+
+//Put - ...
+func (s *LocalStore) Put(ctx context.Context, name string, data []byte, contentType string) error {
+	return ioutil.WriteFile(s.path(name), data, 0644)
+}
+
+//Get - ...
+func (s *LocalStore) Get(ctx context.Context, name string) ([]byte, error) {
+	return ioutil.ReadFile(s.path(name))
+}
+
+//Delete - ...
+func (s *LocalStore) Delete(ctx context.Context, name string) error {
+	if err := os.Remove(s.path(name)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+//URL - ...
+func (s *LocalStore) URL(name string) string {
+	return s.baseURL + name
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+* Brute force protection of the login, with counters of failed attempts per email and per IP in tokensClient,
+* away from codesClient whose keys are looked up with codes sent by users
+* After the free attempts every attempt has to wait twice as long as the previous one,
+* and after the lockout threshold logins are blocked for loginLockout
+ */
+const (
+	loginFailWindow   = time.Hour // failures older than this are forgotten
+	emailFreeAttempts = 3
+	ipFreeAttempts    = 30 // an IP can be shared by many users
+	loginBaseDelay    = time.Second
+	loginMaxDelay     = 5 * time.Minute
+	loginLockout      = 30 * time.Minute
+	emailLockoutAfter = 10
+	ipLockoutAfter    = 100
+)
+
+//loginSubjects - the counter keys of a login attempt, by email and by IP
+func loginSubjects(email string, ip string) []string {
+	return []string{"email:" + strings.ToLower(email), "ip:" + ip}
+}
+
+/*loginWait - how long until a login for email from ip is allowed, 0 if it is allowed now
+*
+ */
+func loginWait(ctx context.Context, email string, ip string) time.Duration {
+	var wait time.Duration
+	for _, subject := range loginSubjects(email, ip) {
+		for _, key := range []string{"login_lock:" + subject, "login_wait:" + subject} {
+			ttl, err := tokensClient.PTTL(ctx, key).Result()
+			if err == nil && ttl > wait {
+				wait = ttl
+			}
+		}
+	}
+	return wait
+}
+
+/*loginFailed - counts a failed login, making the next one wait or locking the account
+* UID is empty when no user has this email, then nobody is notified
+ */
+func loginFailed(ctx context.Context, email string, ip string, UID string) {
+	for _, subject := range loginSubjects(email, ip) {
+		failsKey := "login_fails:" + subject
+		fails, err := tokensClient.Incr(ctx, failsKey).Result()
+		if err != nil {
+			fmt.Println("failed to count login attempt:", err)
+			continue
+		}
+		tokensClient.Expire(ctx, failsKey, loginFailWindow)
+
+		free, lockAfter := int64(ipFreeAttempts), int64(ipLockoutAfter)
+		if strings.HasPrefix(subject, "email:") {
+			free, lockAfter = emailFreeAttempts, emailLockoutAfter
+		}
+		if fails > free {
+			tokensClient.Set(ctx, "login_wait:"+subject, 1, loginBackoff(fails, free))
+		}
+		if fails < lockAfter {
+			continue
+		}
+		locked, err := tokensClient.SetNX(ctx, "login_lock:"+subject, 1, loginLockout).Result()
+		if err != nil || !locked { // already locked, the owner was told
+			continue
+		}
+		log.WithFields(log.Fields{
+			"subject": subject, "uid": UID, "fails": fails,
+		}).Warn("Login locked after too many failed attempts")
+		if UID != "" && strings.HasPrefix(subject, "email:") {
+			notifyLockout(email, ip, UID)
+		}
+	}
+}
+
+//loginSucceeded - forgets the failures of the email, the ones of the IP stay since it may be guessing other accounts
+func loginSucceeded(ctx context.Context, email string) {
+	subject := loginSubjects(email, "")[0]
+	tokensClient.Del(ctx, "login_fails:"+subject, "login_wait:"+subject)
+}
+
+//loginBackoff - wait after the nth failure when the first free ones don't wait, doubling from loginBaseDelay up to loginMaxDelay
+func loginBackoff(fails int64, free int64) time.Duration {
+	exp := float64(fails - free - 1)
+	delay := time.Duration(float64(loginBaseDelay) * math.Pow(2, exp))
+	if delay > loginMaxDelay || delay <= 0 {
+		return loginMaxDelay
+	}
+	return delay
+}
+
+//notifyLockout - tells the owner of the account that logins were blocked, in the language of the owner
+func notifyLockout(email string, ip string, UID string) {
+	var lang string
+	if u, err := DBGetUser(UID); err == nil {
+		lang = u.Lang
+	}
+	notice := map[string]interface{}{
+		"IP":      ip,
+		"Minutes": int(loginLockout.Minutes()),
+	}
+	if err := sendEmail(email, "account_locked", lang, notice); err != nil {
+		fmt.Println("failed to send lockout email:", err)
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/go-redis/redis"
+	log "github.com/sirupsen/logrus"
+	"github.com/twinj/uuid"
+)
+
+//MagicLogin - body of a request to log in without the password
+type MagicLogin struct {
+	Email  string `json:"email" validate:"required,email"`
+	Device string `json:"device" validate:"max=64"`
+}
+
+//MagicVerify - redeems the code, with the email, or the token of the link
+type MagicVerify struct {
+	Email string `json:"email" validate:"omitempty,email"`
+	Code  string `json:"code" validate:"omitempty,len=6,numeric"`
+	Token string `json:"token"`
+}
+
+const (
+	magicLifetime      = 10 * time.Minute
+	magicMaxAttempts   = 5
+	magicEmailInterval = time.Minute
+	magicEmailsPerHour = 5
+)
+
+/*userMagicLogin - emails a single use link and code that log in without the password
+* Always answers the same, so it can't be used to find which emails have an account
+ */
+func userMagicLogin(req *http.Request) Response {
+	var data MagicLogin
+	decoder := json.NewDecoder(req.Body)
+	if err := decoder.Decode(&data); err != nil {
+		return Response{Error: true, Msg: "Invalid request"}
+	}
+	if !_validateInput(data) {
+		return Response{Error: true, Msg: "Invalid email"}
+	}
+	res := Response{Error: false, Msg: "If the email has an account, a login link was sent to it"}
+
+	UID, _, _, err := DBGetHash(data.Email)
+	if err != nil {
+		return res
+	}
+	// a failure must answer the same too, or it would tell the email has an account
+	if err = magicToEmail(data.Email, UID, data.Device, requestLanguage(req)); err != nil {
+		log.WithFields(log.Fields{
+			"uid": UID,
+		}).Info("Failed to send login link email: ", err)
+	}
+	return res
+}
+
+/*userMagicVerify - exchanges the code or link token for access and refresh tokens
+* The email was proven, so the account becomes validated
+ */
+func userMagicVerify(req *http.Request) Response {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var data MagicVerify
+	decoder := json.NewDecoder(req.Body)
+	if err := decoder.Decode(&data); err != nil {
+		return Response{Error: true, Msg: "Invalid request"}
+	}
+	if !_validateInput(data) || (data.Token == "") == (data.Code == "" || data.Email == "") {
+		return Response{Error: true, Msg: "Send either the email and code or the token"}
+	}
+
+	email := data.Email
+	if data.Token != "" {
+		var err error
+		email, err = codesClient.Get(ctx, "magic_token:"+data.Token).Result()
+		if err != nil {
+			return Response{Error: true, Msg: "code does not exist or expired"}
+		}
+	}
+	codeKey := "magic:" + email
+	stored, err := codesClient.HGetAll(ctx, codeKey).Result()
+	if err != nil || len(stored) == 0 {
+		return Response{Error: true, Msg: "code does not exist or expired"}
+	}
+	if data.Token == "" && stored["code"] != data.Code {
+		// the code is short, so only a few guesses are allowed
+		attempts, _ := codesClient.HIncrBy(ctx, codeKey, "attempts", 1).Result()
+		if attempts >= magicMaxAttempts {
+			codesClient.Del(ctx, codeKey, "magic_token:"+stored["token"])
+			log.WithFields(log.Fields{
+				"uid": stored["uid"],
+			}).Info("Too many wrong magic login codes")
+		}
+		return Response{Error: true, Msg: "code does not exist or expired"}
+	}
+	if data.Token != "" && stored["token"] != data.Token { // a newer link replaced this one
+		return Response{Error: true, Msg: "code does not exist or expired"}
+	}
+	// single use, if two requests race only the one that deletes it continues
+	if deleted, err := codesClient.Del(ctx, codeKey).Result(); err != nil || deleted == 0 {
+		return Response{Error: true, Msg: "code does not exist or expired"}
+	}
+	codesClient.Del(ctx, "magic_token:"+stored["token"])
+
+	UID := stored["uid"]
+	if DBValidateUser(UID) != nil {
+		return Response{Error: true, Msg: "DB Error"}
+	}
+	log.WithFields(log.Fields{
+		"uid": UID,
+	}).Info("Magic login redeemed")
+
+	// the email replaces the password, not the second factor
+	totp, err := DBGetTOTP(UID)
+	if err != nil {
+		return Response{Error: true, Msg: "DB Error"}
+	}
+	if totp.Enabled {
+		return mfaChallenge(UID, email, stored["device"])
+	}
+	res := loginTokens(req, UID, stored["device"])
+	if !res.Error {
+		loginSucceeded(ctx, email)
+	}
+	return res
+}
+
+/*magicToEmail - emails a new magic login, replacing the previous one
+* Limited to one email per magicEmailInterval and magicEmailsPerHour per address
+ */
+func magicToEmail(email string, uid string, device string, lang string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	sent, err := codesClient.SetNX(ctx, "magic_sent:"+email, 1, magicEmailInterval).Result()
+	if err != nil {
+		return err
+	}
+	if !sent {
+		return nil
+	}
+	hourKey := "magic_hour:" + email
+	count, err := codesClient.Incr(ctx, hourKey).Result()
+	if err != nil {
+		return err
+	}
+	if count == 1 {
+		codesClient.Expire(ctx, hourKey, time.Hour)
+	}
+	if count > magicEmailsPerHour {
+		return nil
+	}
+
+	code, err := randomDigits(6)
+	if err != nil {
+		return err
+	}
+	token := "m" + uuid.NewV4().String()
+	codeKey := "magic:" + email
+	old, _ := codesClient.HGet(ctx, codeKey, "token").Result()
+	_, err = codesClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, codeKey, "magic_token:"+old)
+		pipe.HSet(ctx, codeKey, "code", code, "token", token, "uid", uid, "device", device, "attempts", 0)
+		pipe.Expire(ctx, codeKey, magicLifetime)
+		pipe.Set(ctx, "magic_token:"+token, email, magicLifetime)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	// opened by the app, which posts the token to /users/login/magic/verify
+	link := config.PublicURL + "/login/magic?token=" + token
+	data := map[string]string{"Code": code, "Link": link, "Expires": fmt.Sprint(magicLifetime)}
+	return sendEmail(email, "magic_login", lang, data)
+}
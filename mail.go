@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"embed"
+	"fmt"
+	htmltemplate "html/template"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+//Email - an email ready to be sent, HTML is optional
+type Email struct {
+	To      string
+	Subject string
+	Text    string
+	HTML    string
+}
+
+//Mailer - sends emails
+type Mailer interface {
+	Send(ctx context.Context, e *Email) error
+}
+
+//mailTemplates - for each language a <name>.txt (with a "subject" block) and a <name>.html template
+//
+//go:embed mail_templates
+var mailTemplates embed.FS
+
+//languages with templates, the first one is used when there is no translation
+var mailLanguages = []string{"en", "pt"}
+
+var mailer Mailer = NewMailer(config.Mail)
+
+/*NewMailer - the Mailer of the configured backend
+*
+ */
+func NewMailer(c MailConfig) Mailer {
+	switch c.Backend {
+	case "mailgun":
+		return NewMailgunMailer(c)
+	case "smtp":
+		return NewSMTPMailer(c)
+	case "dev":
+		return NewDevMailer(c)
+	}
+	log.Fatal(fmt.Errorf("unknown mail backend %q", c.Backend))
+	return nil
+}
+
+/*sendEmail - renders the templates of name in lang and sends the email
+*
+ */
+func sendEmail(email, name, lang string, data interface{}) error {
+	e, err := renderEmail(email, name, lang, data)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*50)
+	defer cancel()
+
+	return mailer.Send(ctx, e)
+}
+
+/*renderEmail - builds an email from the templates of name in lang
+* Falls back to the first of mailLanguages when there is no translation
+ */
+func renderEmail(to, name, lang string, data interface{}) (*Email, error) {
+	lang = supportedLanguage(lang)
+	dir := "mail_templates/" + lang + "/"
+
+	textTmpl, err := template.ParseFS(mailTemplates, dir+name+".txt")
+	if err != nil {
+		return nil, err
+	}
+	var subject, text bytes.Buffer
+	if err = textTmpl.ExecuteTemplate(&subject, "subject", data); err != nil {
+		return nil, err
+	}
+	if err = textTmpl.Execute(&text, data); err != nil {
+		return nil, err
+	}
+
+	e := &Email{To: to, Subject: strings.TrimSpace(subject.String()), Text: strings.TrimSpace(text.String())}
+	if htmlTmpl, err := htmltemplate.ParseFS(mailTemplates, dir+name+".html"); err == nil {
+		var html bytes.Buffer
+		if err = htmlTmpl.Execute(&html, data); err != nil {
+			return nil, err
+		}
+		e.HTML = html.String()
+	}
+	return e, nil
+}
+
+//supportedLanguage - lang if there are templates for it, otherwise the default language
+func supportedLanguage(lang string) string {
+	lang = strings.ToLower(lang)
+	for _, l := range mailLanguages {
+		if strings.HasPrefix(lang, l) {
+			return l
+		}
+	}
+	return mailLanguages[0]
+}
+
+//requestLanguage - preferred language of the client, from the Accept-Language header
+func requestLanguage(req *http.Request) string {
+	for _, part := range strings.Split(req.Header.Get("Accept-Language"), ",") {
+		lang := strings.TrimSpace(strings.Split(part, ";")[0])
+		if lang != "" && lang != "*" {
+			return supportedLanguage(lang)
+		}
+	}
+	return mailLanguages[0]
+}
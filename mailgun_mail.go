@@ -0,0 +1,28 @@
+package main
+
+import (
+	"context"
+
+	"github.com/mailgun/mailgun-go"
+)
+
+//MailgunMailer - Mailer using the mailgun API
+type MailgunMailer struct {
+	mg   mailgun.Mailgun
+	from string
+}
+
+//NewMailgunMailer - ...
+func NewMailgunMailer(c MailConfig) *MailgunMailer {
+	return &MailgunMailer{mg: mailgun.NewMailgun(c.MailgunDomain, c.MailgunAPIKey), from: c.From}
+}
+
+//Send - ...
+func (m *MailgunMailer) Send(ctx context.Context, e *Email) error {
+	msg := m.mg.NewMessage(m.from, e.Subject, e.Text, e.To)
+	if e.HTML != "" {
+		msg.SetHtml(e.HTML)
+	}
+	_, _, err := m.mg.Send(ctx, msg)
+	return err
+}
@@ -1,38 +1,133 @@
 package main
 
 import (
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
 	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/segmentio/ksuid"
 	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
 )
 
 //Message - a message
 type Message struct {
-	MID       string   `json:"mid" bson:"mid"`
-	UID       string   `json:"uid" bson:"uid"`
-	Title     string   `json:"title,omitempty" bson:"title" validate:"required,min=1,max=50"`
-	Text      string   `json:"text,omitempty" bson:"text" validate:"required,min=1,max=500"`
-	Image     string   `json:"image,omitempty" bson:"image,omitempty" validate:"omitempty,base64"`
-	Date      int64    `json:"date,omitempty" bson:"date"`
-	Location  Location `json:"-" bson:"location"`
-	Latitude  float64  `json:"latitude" bson:"latitude"`
-	Longitude float64  `json:"longitude" bson:"longitude"`
-	EvalValue int      `json:"eval_value" bson:"eval_value"`
-	UserEval  string   `json:"user_eval,omitempty" bson:"-"`
+	MID          string        `json:"mid" bson:"mid"`
+	UID          string        `json:"uid" bson:"uid"`
+	Title        string        `json:"title,omitempty" bson:"title" validate:"required,min=1,max=50"`
+	Text         string        `json:"text,omitempty" bson:"text" validate:"required,min=1,max=500"`
+	Image        string        `json:"image,omitempty" bson:"image,omitempty" validate:"omitempty,base64"`
+	Date         int64         `json:"date,omitempty" bson:"date"`
+	Location     Location      `json:"-" bson:"location"`
+	Latitude     float64       `json:"latitude" bson:"latitude"`
+	Longitude    float64       `json:"longitude" bson:"longitude"`
+	EvalValue    int           `json:"eval_value" bson:"eval_value"`
+	CommentCount int           `json:"comment_count" bson:"comment_count"`
+	UserEval     string        `json:"user_eval,omitempty" bson:"-"`
+	EditedAt     int64         `json:"edited_at,omitempty" bson:"edited_at,omitempty"`
+	EditHistory  []MessageEdit `json:"edit_history,omitempty" bson:"edit_history,omitempty"`
+	ExpiresIn    int64         `json:"expires_in,omitempty" bson:"-" validate:"min=0"` // seconds, only used when posting
+	ExpiresAt    int64         `json:"expires_at,omitempty" bson:"expires_at,omitempty"`
+	DistanceM    *float64      `json:"distance_m,omitempty" bson:"distance_m,omitempty"`                                           // only in results of a radius query
+	HotScore     *float64      `json:"hot_score,omitempty" bson:"hot_score,omitempty"`                                             // only when order is hot
+	Visibility   string        `json:"visibility,omitempty" bson:"visibility,omitempty" validate:"omitempty,oneof=public friends"` // defaults to the setting of the author
 }
 
+//MessageEdit - a previous version of a message, kept when the author edits it
+type MessageEdit struct {
+	Title string `json:"title" bson:"title"`
+	Text  string `json:"text" bson:"text"`
+	Date  int64  `json:"date" bson:"date"` // when this version was written
+}
+
+//MessageUpdate - fields of a message the author is allowed to change
+type MessageUpdate struct {
+	Title string `json:"title" bson:"title" validate:"required,min=1,max=50"`
+	Text  string `json:"text" bson:"text" validate:"required,min=1,max=500"`
+}
+
+//FeedCursor - position in the feed of the last message sent, given to the client as next_cursor
+type FeedCursor struct {
+	Order    string  `json:"o"`
+	Value    int64   `json:"v"`           // date or eval_value of the last message, depending on order
+	Distance float64 `json:"d,omitempty"` // distance of the last message when order is near
+	Score    float64 `json:"s,omitempty"` // hot_score of the last message when order is hot
+	Now      int64   `json:"t,omitempty"` // time the hot scores were computed for
+	MID      string  `json:"m"`
+}
+
+//MsgArea - part of the map being queried, a radius around Near or the Within polygon
+type MsgArea struct {
+	Near   *Location
+	Radius int
+	Within *Polygon
+}
+
+const feedMaxLimit = 500
+
+//radius limits in meters of the nearby feed
+const (
+	minRadius = 10
+	maxRadius = 1000000
+)
+
+//Cluster - group of messages close to each other, shown instead of the messages when the map is zoomed out
+type Cluster struct {
+	Count     int     `json:"count" bson:"count"`
+	Latitude  float64 `json:"latitude" bson:"latitude"`
+	Longitude float64 `json:"longitude" bson:"longitude"`
+	Top       Message `json:"top" bson:"top"` // message with the highest eval_value
+}
+
+//clusters are cells of a grid with clusterCellsPerTile cells across each map tile
+const (
+	clusterCellsPerTile = 4
+	clusterMaxZoom      = 22
+)
+
 //Location - Type is normally "Point"
 type Location struct {
 	Type        string    `json:"type" bson:"type"`
 	Coordinates []float64 `json:"coordinates" bson:"coordinates"` // first longitude then latitude
 }
 
+//Polygon - GeoJSON polygon, the first ring is the outer boundary and the others are holes
+type Polygon struct {
+	Type        string        `json:"type" bson:"type"`
+	Coordinates [][][]float64 `json:"coordinates" bson:"coordinates"` // rings of [longitude, latitude]
+}
+
+//check - validates the polygon so mongo does not have to
+func (p Polygon) check() error {
+	if p.Type != "Polygon" || len(p.Coordinates) == 0 {
+		return errors.New("Polygon Invalid")
+	}
+	for _, ring := range p.Coordinates {
+		if len(ring) < 4 {
+			return errors.New("Polygon Invalid, rings need at least 4 positions")
+		}
+		for _, pos := range ring {
+			if len(pos) != 2 || pos[1] < -90.0 || pos[1] > 90.0 || pos[0] < -180.0 || pos[0] > 180.0 {
+				return errors.New("Polygon Invalid, coordinates are not earth coordinates")
+			}
+		}
+		first, last := ring[0], ring[len(ring)-1]
+		if first[0] != last[0] || first[1] != last[1] {
+			return errors.New("Polygon Invalid, rings must be closed")
+		}
+	}
+	return nil
+}
+
 /*
 *
  */
@@ -65,9 +160,20 @@ func createMsg(req *http.Request) Response {
 	msg.UID = tokenAuth.UID
 	msg.Location = Location{Type: "Point", Coordinates: []float64{msg.Longitude, msg.Latitude}}
 	msg.EvalValue = 0
+	msg.CommentCount = 0
+	if msg.Visibility == "" {
+		settings, err := DBGetSettings(tokenAuth.UID)
+		if err != nil {
+			return Response{Error: true, Msg: "DB Error"}
+		}
+		msg.Visibility = settings.withDefaults().DefaultVisibility
+	}
+	if lifetime := messageLifetime(msg.ExpiresIn); lifetime > 0 {
+		msg.ExpiresAt = msg.Date + lifetime
+	}
 
 	if msg.Image != "" {
-		imageURL, err := UploadBytesToBlob(JpegToBytes(b64ToJpeg(msg.Image)))
+		imageURL, err := uploadImage(JpegToBytes(b64ToJpeg(msg.Image)))
 		if err != nil {
 			fmt.Println("error uploading image:", err)
 		}
@@ -85,9 +191,171 @@ func createMsg(req *http.Request) Response {
 
 }
 
+/*editMsg - changes the title and text of a message
+* Only the author of the message can edit it. The old version is kept in edit_history
+ */
+func editMsg(req *http.Request) Response {
+	tokenAuth, err := ExtractTokenMetadata(req)
+	if err != nil {
+		return Response{Error: true, Msg: err.Error()}
+	}
+	MID := mux.Vars(req)["MID"]
+
+	decoder := json.NewDecoder(req.Body)
+	var upd MessageUpdate
+	err = decoder.Decode(&upd)
+	if err != nil {
+		fmt.Println("Failed to read request.")
+		return Response{Error: true, Msg: "Failed to read request."}
+	}
+	if !_validateInput(upd) {
+		return Response{Error: true, Msg: "Message sent was invalid. Edit Failed"}
+	}
+
+	msg, err := DBGetMessage(MID)
+	if err != nil || !canSeeMessage(msg, tokenAuth.UID) { // expired messages are gone, even for their author
+		return Response{Error: true, Msg: "Message does not exist"}
+	}
+	if msg.UID != tokenAuth.UID {
+		log.WithFields(log.Fields{
+			"uid": tokenAuth.UID, "mid": MID,
+		}).Info("Tried to edit message of another user")
+		return Response{Error: true, Msg: "Unauthorized"}
+	}
+
+	err = DBEditMessage(msg, upd.Title, upd.Text)
+	if err == mongo.ErrNoDocuments { // expired since it was read
+		return Response{Error: true, Msg: "Message does not exist"}
+	}
+	if err != nil {
+		return Response{Error: true, Msg: "Error in the DB"}
+	}
+	return Response{Error: false, Msg: "Message edited successfully"}
+}
+
+/*getMsgHistory - previous versions of a message, oldest first
+* The feeds leave the history out, it is only sent here to those who can see the message
+ */
+func getMsgHistory(req *http.Request) Response {
+	tokenAuth, err := ExtractTokenMetadata(req)
+	if err != nil {
+		return Response{Error: true, Msg: err.Error()}
+	}
+	msg, err := DBGetMessage(mux.Vars(req)["MID"])
+	if err != nil || !canSeeMessage(msg, tokenAuth.UID) {
+		return Response{Error: true, Msg: "Message does not exist"}
+	}
+	history := msg.EditHistory
+	if history == nil {
+		history = []MessageEdit{}
+	}
+	dataResp, err := json.Marshal(history)
+	if err != nil {
+		return Response{Error: true, Msg: err.Error()}
+	}
+	return Response{Error: false, Msg: "Request successfully completed", Data: dataResp}
+}
+
+/*deleteMsg - deletes a message, its evaluations and its image
+* Only the author of the message can delete it
+ */
+func deleteMsg(req *http.Request) Response {
+	tokenAuth, err := ExtractTokenMetadata(req)
+	if err != nil {
+		return Response{Error: true, Msg: err.Error()}
+	}
+	MID := mux.Vars(req)["MID"]
+
+	msg, err := DBGetMessage(MID)
+	if err != nil {
+		return Response{Error: true, Msg: "Message does not exist"}
+	}
+	if msg.UID != tokenAuth.UID {
+		log.WithFields(log.Fields{
+			"uid": tokenAuth.UID, "mid": MID,
+		}).Info("Tried to delete message of another user")
+		return Response{Error: true, Msg: "Unauthorized"}
+	}
+
+	if DBDeleteMessage(MID, tokenAuth.UID) != nil {
+		return Response{Error: true, Msg: "Error in the DB"}
+	}
+	if msg.Image != "" {
+		if err := deleteImage(msg.Image); err != nil { // message is already gone, just log it
+			log.WithFields(log.Fields{
+				"mid": MID, "image": msg.Image,
+			}).Info("Failed to delete image of deleted message")
+		}
+	}
+	return Response{Error: false, Msg: "Message deleted successfully"}
+}
+
+/*messageLifetime - lifetime in seconds of a new message, 0 if it never expires
+* Applies the server default and maximum to what the client asked for
+ */
+func messageLifetime(expiresIn int64) int64 {
+	defaultLifetime := int64(config.MsgDefaultLifetime.Seconds())
+	maxLifetime := int64(config.MsgMaxLifetime.Seconds())
+
+	lifetime := expiresIn
+	if lifetime == 0 {
+		lifetime = defaultLifetime
+	}
+	if maxLifetime > 0 && (lifetime == 0 || lifetime > maxLifetime) {
+		lifetime = maxLifetime
+	}
+	return lifetime
+}
+
+/*sweepExpiredMessages - periodically removes expired messages, their evaluations and images
+* Expired messages are already hidden from queries, this only frees the space
+ */
+func sweepExpiredMessages(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		images, err := DBDeleteExpiredMessages()
+		if err != nil { // the messages deleted before the error still have their images removed
+			log.WithFields(log.Fields{
+				"request": "sweepExpiredMessages",
+			}).Info(err)
+		}
+		for _, image := range images {
+			if err := deleteImage(image); err != nil {
+				log.WithFields(log.Fields{
+					"image": image,
+				}).Info("Failed to delete image of expired message")
+			}
+		}
+	}
+}
+
+/*reconcileEvals - admin routine that fixes eval_value drifted from the evaluations in likesColl
+* mids is a comma separated list of MIDs, or "all" for every message and comment
+ */
+func reconcileEvals(mids string) error {
+	var MIDs []string
+	if mids != "all" {
+		MIDs = strings.Split(mids, ",")
+	}
+	fixed, err := DBReconcileEvals(MIDs)
+	if err != nil {
+		return err
+	}
+	fmt.Println("messages fixed:", fixed)
+	if mids == "all" {
+		fixed, err = DBReconcileCommentEvals(nil)
+		if err != nil {
+			return err
+		}
+		fmt.Println("comments fixed:", fixed)
+	}
+	return nil
+}
+
 /*reqMsgZone-
-* Request messages to DB from current zone and all adjacent zones (including diagonals)
-* Considering intervals of
+* Request messages to DB in a radius around the given latitude and longitude
+* The radius (in meters) is optional and limited to [minRadius, maxRadius]
  */
 func reqMsgZone(req *http.Request) Response {
 	tokenAuth, err := ExtractTokenMetadata(req)
@@ -95,63 +363,232 @@ func reqMsgZone(req *http.Request) Response {
 		return Response{Error: true, Msg: err.Error()}
 
 	}
-	DBListFriend(tokenAuth.UID)
 
 	qParams := req.URL.Query()
 	latstr := qParams.Get("latitude")
 	longstr := qParams.Get("longitude")
-	order := qParams.Get("order")
-	group := qParams.Get("group")
 
 	//latstr := req.Header.Get("latitude")
 	//longstr := req.Header.Get("longitude")
 
-	latitude, err := strconv.ParseFloat(latstr, 8)
+	latitude, longitude, err := parseCoordinates(latstr, longstr)
 	if err != nil {
 		fmt.Println(err)
-		return Response{Error: true, Msg: "Latitude Invalid"}
+		return Response{Error: true, Msg: err.Error()}
+	}
 
+	radius := maxRadius
+	if r := qParams.Get("radius"); r != "" {
+		radius, err = strconv.Atoi(r)
+		if err != nil || radius < minRadius || radius > maxRadius {
+			return Response{Error: true, Msg: fmt.Sprintf("Radius Invalid, must be between %d and %d meters", minRadius, maxRadius)}
+		}
 	}
-	longitude, err := strconv.ParseFloat(longstr, 8)
+
+	location := Location{Type: "Point", Coordinates: []float64{longitude, latitude}}
+	return msgFeed(tokenAuth.UID, MsgArea{Near: &location, Radius: radius}, qParams)
+}
+
+/*reqMsgWithin - Request messages to DB inside the visible part of the map
+* Takes either a bounding box (sw_lat, sw_long, ne_lat, ne_long) or a GeoJSON polygon in the polygon parameter
+ */
+func reqMsgWithin(req *http.Request) Response {
+	tokenAuth, err := ExtractTokenMetadata(req)
 	if err != nil {
-		fmt.Println(err)
-		return Response{Error: true, Msg: "Longitude Invalid"}
+		return Response{Error: true, Msg: err.Error()}
+	}
+	qParams := req.URL.Query()
 
+	var area Polygon
+	if p := qParams.Get("polygon"); p != "" {
+		err = json.Unmarshal([]byte(p), &area)
+		if err != nil {
+			return Response{Error: true, Msg: "Polygon Invalid"}
+		}
+	} else {
+		area, err = parseBoundingBox(qParams.Get("sw_lat"), qParams.Get("sw_long"), qParams.Get("ne_lat"), qParams.Get("ne_long"))
+		if err != nil {
+			return Response{Error: true, Msg: err.Error()}
+		}
+	}
+	if err = area.check(); err != nil {
+		return Response{Error: true, Msg: err.Error()}
 	}
-	if latitude < -90.0 || latitude > 90.0 || longitude < -180.0 || longitude > 180.0 {
-		fmt.Println("Coordinates are invalid. Please return to using earth coordinates.")
-		return Response{Error: true, Msg: "Coordinates are invalid. Please return to using earth coordinates."}
 
+	return msgFeed(tokenAuth.UID, MsgArea{Within: &area}, qParams)
+}
+
+/*reqMsgClusters - Request the messages of the visible area of the map grouped in clusters
+* bbox is "sw_long,sw_lat,ne_long,ne_lat" and zoom the zoom level of the map, which sets the size of the cells
+ */
+func reqMsgClusters(req *http.Request) Response {
+	tokenAuth, err := ExtractTokenMetadata(req)
+	if err != nil {
+		return Response{Error: true, Msg: err.Error()}
 	}
-	UID := tokenAuth.UID
+	qParams := req.URL.Query()
+	group := qParams.Get("group")
 
-	location := Location{Type: "Point", Coordinates: []float64{longitude, latitude}}
+	corners := strings.Split(qParams.Get("bbox"), ",")
+	if len(corners) != 4 {
+		return Response{Error: true, Msg: "Bounding box Invalid, use sw_long,sw_lat,ne_long,ne_lat"}
+	}
+	area, err := parseBoundingBox(corners[1], corners[0], corners[3], corners[2])
+	if err != nil {
+		return Response{Error: true, Msg: err.Error()}
+	}
+	zoom, err := strconv.Atoi(qParams.Get("zoom"))
+	if err != nil || zoom < 0 || zoom > clusterMaxZoom {
+		return Response{Error: true, Msg: "Zoom Invalid"}
+	}
+	cellSize := 360.0 / math.Exp2(float64(zoom)) / clusterCellsPerTile
 
-	results, err := DBQueryMessages(location, 1000000, UID, order, group)
+	geoFilter := bson.M{"$geoWithin": bson.M{"$geometry": area}}
+	clusters, err := DBClusterMessages(geoFilter, tokenAuth.UID, group, cellSize)
 	if err != nil {
 		log.WithFields(log.Fields{
-			"uid": UID, "request": "reqMsgZone",
+			"uid": tokenAuth.UID, "request": "reqMsgClusters",
+		}).Info(err)
+		return Response{Error: true, Msg: "Error in the database"}
+	}
+
+	dataResp, err := json.Marshal(bson.M{"clusters": clusters})
+	if err != nil {
+		return Response{Error: true, Msg: err.Error()}
+	}
+	return Response{Error: false, Msg: "Request successfully completed", Data: dataResp}
+}
+
+/*msgFeed - queries the messages in area and builds the feed response
+* Handles the order, group, limit and cursor parameters shared by every feed
+ */
+func msgFeed(UID string, area MsgArea, qParams url.Values) Response {
+	var err error
+	order := qParams.Get("order")
+	group := qParams.Get("group")
+
+	var limit int64 = feedMaxLimit
+	if l := qParams.Get("limit"); l != "" {
+		limit, err = strconv.ParseInt(l, 10, 64)
+		if err != nil || limit < 1 || limit > feedMaxLimit {
+			return Response{Error: true, Msg: "Limit Invalid"}
+		}
+	}
+	var after *FeedCursor
+	now := time.Now().Unix()
+	if c := qParams.Get("cursor"); c != "" {
+		after, err = decodeFeedCursor(c, order)
+		if err != nil {
+			return Response{Error: true, Msg: "Cursor Invalid"}
+		}
+		if after.Now != 0 {
+			now = after.Now
+		}
+	}
+
+	// ask for one more to know if there is a next page
+	results, err := DBQueryMessages(area, UID, order, group, after, limit+1)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"uid": UID, "request": "msgFeed",
 		}).Info(err)
 		fmt.Println(err.Error())
 		return Response{Error: true, Msg: "Error in the database"}
 	}
+	nextCursor := ""
+	if int64(len(results)) > limit {
+		results = results[:limit]
+		nextCursor = encodeFeedCursor(results[limit-1], order, now)
+	}
 	// add what they eval'd in that msg
+	MIDs := make([]string, len(results))
+	for i, r := range results {
+		MIDs[i] = r.MID
+	}
+	evals, err := DBCheckUserEvals(UID, MIDs)
+	if err != nil {
+		return Response{Error: true, Msg: "Error in the database"}
+	}
 	for i := range results {
-		r := &results[i]
-		eval, err := DBCheckUserEval(UID, r.MID)
-		if err != nil {
-			return Response{Error: true, Msg: "Error in the database"}
-		}
-		r.UserEval = eval
+		results[i].UserEval = evals[results[i].MID]
 	}
 
-	dataResp, err := json.Marshal(results)
+	dataResp, err := json.Marshal(bson.M{"messages": results, "next_cursor": nextCursor})
 	if err != nil {
 		return Response{Error: true, Msg: err.Error()}
 	}
 	return Response{Error: false, Msg: "Request successfully completed", Data: dataResp}
 }
 
+//parseCoordinates - parses and checks a latitude and longitude
+func parseCoordinates(latstr string, longstr string) (float64, float64, error) {
+	latitude, err := strconv.ParseFloat(latstr, 64)
+	if err != nil {
+		return 0, 0, errors.New("Latitude Invalid")
+	}
+	longitude, err := strconv.ParseFloat(longstr, 64)
+	if err != nil {
+		return 0, 0, errors.New("Longitude Invalid")
+	}
+	if latitude < -90.0 || latitude > 90.0 || longitude < -180.0 || longitude > 180.0 {
+		return 0, 0, errors.New("Coordinates are invalid. Please return to using earth coordinates.")
+	}
+	return latitude, longitude, nil
+}
+
+//parseBoundingBox - polygon of the box between the south-west and north-east corners
+func parseBoundingBox(swLat, swLong, neLat, neLong string) (Polygon, error) {
+	s, w, err := parseCoordinates(swLat, swLong)
+	if err != nil {
+		return Polygon{}, err
+	}
+	n, e, err := parseCoordinates(neLat, neLong)
+	if err != nil {
+		return Polygon{}, err
+	}
+	if s >= n || w >= e {
+		return Polygon{}, errors.New("Bounding box Invalid, sw must be south-west of ne and not cross the antimeridian")
+	}
+	ring := [][]float64{{w, s}, {e, s}, {e, n}, {w, n}, {w, s}}
+	return Polygon{Type: "Polygon", Coordinates: [][][]float64{ring}}, nil
+}
+
+//encodeFeedCursor - opaque cursor pointing after msg in a feed sorted by order, now is when the feed was first requested
+func encodeFeedCursor(msg Message, order string, now int64) string {
+	c := FeedCursor{Order: order, Value: int64(msg.EvalValue), MID: msg.MID}
+	switch order {
+	case "new":
+		c.Value = msg.Date
+	case "near":
+		if msg.DistanceM != nil {
+			c.Distance = *msg.DistanceM
+		}
+	case "hot":
+		if msg.HotScore != nil {
+			c.Score = *msg.HotScore
+		}
+		c.Now = now
+	}
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+//decodeFeedCursor - reads a cursor made by encodeFeedCursor, it must be for the same order
+func decodeFeedCursor(s string, order string) (*FeedCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	var c FeedCursor
+	if err = json.Unmarshal(b, &c); err != nil {
+		return nil, err
+	}
+	if c.Order != order || c.MID == "" {
+		return nil, errors.New("cursor is from another feed")
+	}
+	return &c, nil
+}
+
 /*
 *
  */
@@ -169,6 +606,11 @@ func updateEval(req *http.Request) Response {
 	UID := tokenAuth.UID
 	fmt.Println(MID, eval)
 
+	msg, err := DBGetMessage(MID)
+	if err != nil || !canSeeMessage(msg, UID) {
+		return Response{Error: true, Msg: "Message does not exist"}
+	}
+
 	err = DBUpdateEval(MID, UID, eval)
 	if err != nil {
 		return Response{Error: true, Msg: "Could not Like/Dislike this message"}
@@ -180,11 +622,19 @@ func updateEval(req *http.Request) Response {
 *
  */
 func getEval(req *http.Request) Response {
+	tokenAuth, err := ExtractTokenMetadata(req)
+	if err != nil {
+		return Response{Error: true, Msg: err.Error()}
+	}
 	MID := mux.Vars(req)["MID"]
 	eval, err := strconv.Atoi(mux.Vars(req)["eval"]) //This can be either 0 or 1
 	if err != nil {
 		return Response{Error: true, Msg: err.Error()}
 	}
+	msg, err := DBGetMessage(MID)
+	if err != nil || !canSeeMessage(msg, tokenAuth.UID) {
+		return Response{Error: true, Msg: "Message does not exist"}
+	}
 	res, err := DBGetMsgEval(MID, eval)
 	if err != nil {
 		return Response{Error: true, Msg: err.Error()}
@@ -196,3 +646,25 @@ func getEval(req *http.Request) Response {
 
 	return Response{Error: false, Data: dataRes, Msg: "Retrieved eval list successfully"}
 }
+
+/*canSeeMessage - whether the viewer can see msg, the same rules messagesFilter applies to the feeds
+* Expired messages are seen by nobody, messages only for friends by the friends and the author
+ */
+func canSeeMessage(msg *Message, viewerUID string) bool {
+	if msg.ExpiresAt != 0 && msg.ExpiresAt <= time.Now().Unix() {
+		return false
+	}
+	if msg.Visibility != "friends" || msg.UID == viewerUID {
+		return true
+	}
+	friends, err := DBListFriend(viewerUID)
+	if err != nil {
+		return false
+	}
+	for _, f := range friends {
+		if f == msg.UID {
+			return true
+		}
+	}
+	return false
+}
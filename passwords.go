@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"time"
+
+	"github.com/go-redis/redis"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
+)
+
+//ForgotPassword - body of a request to reset the password
+type ForgotPassword struct {
+	Email string `json:"email" validate:"required,email"`
+}
+
+//ResetPassword - body of a request to set a new password with the emailed code
+type ResetPassword struct {
+	Email       string `json:"email" validate:"required,email"`
+	Code        string `json:"code" validate:"required,len=6,numeric"`
+	NewPassword string `json:"new_password" validate:"required,min=8"`
+}
+
+//ChangePassword - body of a request to change the password of a logged in user
+type ChangePassword struct {
+	CurrentPassword string `json:"current_password" validate:"required"`
+	NewPassword     string `json:"new_password" validate:"required,min=8"`
+}
+
+const (
+	resetCodeLifetime    = 15 * time.Minute
+	resetCodeMaxAttempts = 5
+	resetEmailInterval   = time.Minute // minimum time between two emails to the same address
+	resetCodesPerDay     = 5           // with resetCodeMaxAttempts, at most 25 guesses a day of a 6 digit code
+)
+
+/*userForgotPassword - emails a single use code to reset the password
+* Always answers the same, so it can't be used to find which emails have an account
+ */
+func userForgotPassword(req *http.Request) Response {
+	var data ForgotPassword
+	decoder := json.NewDecoder(req.Body)
+	if err := decoder.Decode(&data); err != nil {
+		return Response{Error: true, Msg: "Invalid request"}
+	}
+	if !_validateInput(data) {
+		return Response{Error: true, Msg: "Invalid email"}
+	}
+	res := Response{Error: false, Msg: "If the email has an account, a code was sent to it"}
+
+	UID, _, _, err := DBGetHash(data.Email)
+	if err != nil {
+		return res
+	}
+	// a failure must answer the same too, or it would tell the email has an account
+	if err = resetCodeToEmail(data.Email, UID, requestLanguage(req)); err != nil {
+		log.WithFields(log.Fields{
+			"uid": UID,
+		}).Info("Failed to send password reset email: ", err)
+	}
+	return res
+}
+
+/*userResetPassword - sets a new password if the code is right and logs out every session of the user
+*
+ */
+func userResetPassword(req *http.Request) Response {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var data ResetPassword
+	decoder := json.NewDecoder(req.Body)
+	if err := decoder.Decode(&data); err != nil {
+		return Response{Error: true, Msg: "Invalid request"}
+	}
+	if !_validateInput(data) {
+		return Response{Error: true, Msg: "Invalid reset data"}
+	}
+
+	codeKey := "reset:" + data.Email
+	attemptsKey := "reset_attempts:" + data.Email
+	stored, err := codesClient.HGetAll(ctx, codeKey).Result()
+	if err != nil || len(stored) == 0 {
+		return Response{Error: true, Msg: "code does not exist or expired"}
+	}
+	if stored["code"] != data.Code {
+		// the code is short, so only a few guesses are allowed
+		attempts, _ := codesClient.Incr(ctx, attemptsKey).Result()
+		codesClient.Expire(ctx, attemptsKey, resetCodeLifetime)
+		if attempts >= resetCodeMaxAttempts {
+			codesClient.Del(ctx, codeKey, attemptsKey)
+			log.WithFields(log.Fields{
+				"uid": stored["uid"],
+			}).Info("Too many wrong password reset codes")
+		}
+		return Response{Error: true, Msg: "code does not exist or expired"}
+	}
+	// single use, if two requests race only the one that deletes it continues
+	if deleted, err := codesClient.Del(ctx, codeKey).Result(); err != nil || deleted == 0 {
+		return Response{Error: true, Msg: "code does not exist or expired"}
+	}
+	codesClient.Del(ctx, attemptsKey)
+
+	UID := stored["uid"]
+	hash, err := bcrypt.GenerateFromPassword([]byte(data.NewPassword), 12)
+	if err != nil {
+		return Response{Error: true, Msg: "An error occurred, please try again"}
+	}
+	if DBUpdatePassword(UID, string(hash)) != nil {
+		return Response{Error: true, Msg: "DB Error"}
+	}
+	if RevokeAllTokens(UID) != nil {
+		return Response{Error: true, Msg: "Password changed but could not log out other sessions"}
+	}
+	log.WithFields(log.Fields{
+		"uid": UID,
+	}).Info("Password reset")
+	return Response{Error: false, Msg: "Password changed successfully"}
+}
+
+/*userChangePassword - changes the password of the logged in user, who must know the current one
+* Every other session of the user is logged out
+ */
+func userChangePassword(req *http.Request) Response {
+	tokenAuth, err := ExtractTokenMetadata(req)
+	if err != nil {
+		return Response{Error: true, Msg: err.Error()}
+	}
+	var data ChangePassword
+	decoder := json.NewDecoder(req.Body)
+	if err = decoder.Decode(&data); err != nil {
+		return Response{Error: true, Msg: "Invalid request"}
+	}
+	if !_validateInput(data) {
+		return Response{Error: true, Msg: "Invalid password data"}
+	}
+
+	hashedPassword, err := DBGetPasswordHash(tokenAuth.UID)
+	if err != nil {
+		return Response{Error: true, Msg: "DB Error"}
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(data.CurrentPassword)) != nil {
+		log.WithFields(log.Fields{
+			"uid": tokenAuth.UID,
+		}).Info("Wrong current password when changing password")
+		return Response{Error: true, Msg: "Current password is wrong"}
+	}
+	if data.NewPassword == data.CurrentPassword {
+		return Response{Error: true, Msg: "New password must be different from the current one"}
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(data.NewPassword), 12)
+	if err != nil {
+		return Response{Error: true, Msg: "An error occurred, please try again"}
+	}
+	if DBUpdatePassword(tokenAuth.UID, string(hash)) != nil {
+		return Response{Error: true, Msg: "DB Error"}
+	}
+	if RevokeOtherTokens(tokenAuth.UID, tokenAuth.SessionID) != nil {
+		return Response{Error: true, Msg: "Password changed but could not log out other sessions"}
+	}
+	log.WithFields(log.Fields{
+		"uid": tokenAuth.UID,
+	}).Info("Password changed")
+	return Response{Error: false, Msg: "Password changed successfully"}
+}
+
+/*resetCodeToEmail - emails a new password reset code for uid, replacing any previous one
+* Does nothing if a code was sent to this email less than resetEmailInterval ago or resetCodesPerDay were sent today
+ */
+func resetCodeToEmail(email, uid, lang string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	sent, err := codesClient.SetNX(ctx, "reset_sent:"+email, 1, resetEmailInterval).Result()
+	if err != nil {
+		return err
+	}
+	if !sent {
+		return nil
+	}
+	dayKey := "reset_day:" + email
+	count, err := codesClient.Incr(ctx, dayKey).Result()
+	if err != nil {
+		return err
+	}
+	if count == 1 {
+		codesClient.Expire(ctx, dayKey, 24*time.Hour)
+	}
+	if count > resetCodesPerDay {
+		log.WithFields(log.Fields{
+			"uid": uid,
+		}).Info("Daily limit of password reset codes reached")
+		return nil
+	}
+
+	code, err := randomDigits(6)
+	if err != nil {
+		return err
+	}
+	codeKey := "reset:" + email
+	_, err = codesClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, codeKey, "reset_attempts:"+email)
+		pipe.HSet(ctx, codeKey, "code", code, "uid", uid)
+		pipe.Expire(ctx, codeKey, resetCodeLifetime)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	data := map[string]string{"Code": code, "Expires": fmt.Sprint(resetCodeLifetime)}
+	return sendEmail(email, "password_reset", lang, data)
+}
+
+//randomDigits - random numeric code with n digits
+func randomDigits(n int) (string, error) {
+	code := make([]byte, n)
+	for i := range code {
+		d, err := rand.Int(rand.Reader, big.NewInt(10))
+		if err != nil {
+			return "", err
+		}
+		code[i] = byte('0' + d.Int64())
+	}
+	return string(code), nil
+}
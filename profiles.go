@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+//ProfileBrief - the little that is shown of a user in lists
+type ProfileBrief struct {
+	UID      string `json:"uid" bson:"uid"`
+	Username string `json:"username" bson:"username"`
+	Image    string `json:"image,omitempty" bson:"image"`
+}
+
+/*Profile - what a user sees of another user
+* LastSeen and MutualFriends are only filled for friends that did not hide them
+ */
+type Profile struct {
+	ProfileBrief
+	CreatedAt     int64          `json:"created_at"`
+	Karma         int64          `json:"karma"` // sum of the evaluations of the messages and comments of the user
+	FriendCount   int64          `json:"friend_count"`
+	Friend        bool           `json:"friend"`
+	LastSeen      int64          `json:"last_seen,omitempty"`
+	MutualFriends []ProfileBrief `json:"mutual_friends,omitempty"`
+}
+
+//SelfProfile - what a user sees of itself, everything but secrets
+type SelfProfile struct {
+	Profile
+	Email            string       `json:"email"`
+	ValidatedAccount bool         `json:"validated_account"`
+	LastChangedName  int64        `json:"last_changed_name,omitempty"`
+	TwoFactor        bool         `json:"two_factor"`
+	Settings         UserSettings `json:"settings"`
+}
+
+/*userGetMe - full profile of the logged in user
+*
+ */
+func userGetMe(req *http.Request) Response {
+	tokenAuth, err := ExtractTokenMetadata(req)
+	if err != nil {
+		return Response{Error: true, Msg: err.Error()}
+	}
+	u, err := DBGetUser(tokenAuth.UID)
+	if err != nil {
+		return Response{Error: true, Msg: "DB Error"}
+	}
+	profile, err := baseProfile(u)
+	if err != nil {
+		return Response{Error: true, Msg: "DB Error"}
+	}
+	profile.LastSeen = lastSeen(u)
+	totp, err := DBGetTOTP(u.UID)
+	if err != nil {
+		return Response{Error: true, Msg: "DB Error"}
+	}
+
+	me := SelfProfile{
+		Profile:          *profile,
+		Email:            u.Email,
+		ValidatedAccount: u.ValidatedAccount,
+		LastChangedName:  u.LastChangedName,
+		TwoFactor:        totp.Enabled,
+		Settings:         u.Settings.withDefaults(),
+	}
+	meJSON, err := json.Marshal(me)
+	if err != nil {
+		return Response{Error: true, Msg: "error processing information"}
+	}
+	return Response{Error: false, Data: meJSON}
+}
+
+/*userGetProfile - public profile of a user, friends see more unless the user hid it
+*
+ */
+func userGetProfile(req *http.Request) Response {
+	tokenAuth, err := ExtractTokenMetadata(req)
+	if err != nil {
+		return Response{Error: true, Msg: err.Error()}
+	}
+	UID := mux.Vars(req)["UID"]
+	u, err := DBGetUser(UID)
+	if err == mongo.ErrNoDocuments || (err == nil && u.Deleted) { // accounts being deleted are already gone for others
+		return Response{Error: true, Msg: "UID does not exist"}
+	}
+	if err != nil {
+		return Response{Error: true, Msg: "DB Error"}
+	}
+	profile, err := baseProfile(u)
+	if err != nil {
+		return Response{Error: true, Msg: "DB Error"}
+	}
+
+	if UID != tokenAuth.UID {
+		viewerFriends, err := DBListFriend(tokenAuth.UID)
+		if err != nil {
+			return Response{Error: true, Msg: "DB Error"}
+		}
+		for _, f := range viewerFriends {
+			if f == UID {
+				profile.Friend = true
+			}
+		}
+		if !profile.Friend && u.Settings.HideProfile { // as if it did not exist
+			return Response{Error: true, Msg: "UID does not exist"}
+		}
+		if profile.Friend && !u.Settings.HideLastSeen {
+			profile.LastSeen = lastSeen(u)
+		}
+		if profile.Friend && !u.Settings.HideMutualFriends {
+			profile.MutualFriends, err = mutualFriends(viewerFriends, UID)
+			if err != nil {
+				return Response{Error: true, Msg: "DB Error"}
+			}
+		}
+	}
+
+	profileJSON, err := json.Marshal(profile)
+	if err != nil {
+		return Response{Error: true, Msg: "error processing information"}
+	}
+	return Response{Error: false, Data: profileJSON}
+}
+
+//baseProfile - the part of the profile everyone sees
+func baseProfile(u *User) (*Profile, error) {
+	karma, err := DBGetKarma(u.UID)
+	if err != nil {
+		return nil, err
+	}
+	friends, err := DBCountFriends(u.UID)
+	if err != nil {
+		return nil, err
+	}
+	return &Profile{
+		ProfileBrief: ProfileBrief{UID: u.UID, Username: u.Username, Image: u.Image},
+		CreatedAt:    u.CreatedAt,
+		Karma:        karma,
+		FriendCount:  friends,
+	}, nil
+}
+
+/*lastSeen - last time the user logged in or used one of its sessions
+*
+ */
+func lastSeen(u *User) int64 {
+	seen := u.LastAccess
+	sessions, err := ListSessions(u.UID)
+	if err != nil {
+		return seen
+	}
+	for _, s := range sessions {
+		if s.LastUsedAt.Unix() > seen {
+			seen = s.LastUsedAt.Unix()
+		}
+	}
+	return seen
+}
+
+//mutualFriends - friends of UID that are also in viewerFriends
+func mutualFriends(viewerFriends []string, UID string) ([]ProfileBrief, error) {
+	friends, err := DBListFriend(UID)
+	if err != nil {
+		return nil, err
+	}
+	isViewerFriend := make(map[string]bool, len(viewerFriends))
+	for _, f := range viewerFriends {
+		isViewerFriend[f] = true
+	}
+	var mutual []string
+	for _, f := range friends {
+		if isViewerFriend[f] {
+			mutual = append(mutual, f)
+		}
+	}
+	if len(mutual) == 0 {
+		return nil, nil
+	}
+	return DBGetProfileBriefs(mutual)
+}
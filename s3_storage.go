@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+//S3Store - BlobStore in a bucket of an S3 compatible service (AWS, MinIO...)
+type S3Store struct {
+	client  *minio.Client
+	bucket  string
+	baseURL string
+}
+
+//NewS3Store - store in the configured bucket, which must exist
+func NewS3Store(c StorageConfig) (*S3Store, error) {
+	client, err := minio.New(c.S3Endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(c.S3AccessKey, c.S3SecretKey, ""),
+		Secure: c.S3UseSSL,
+		Region: c.S3Region,
+	})
+	if err != nil {
+		return nil, err
+	}
+	baseURL := c.S3PublicURL
+	if baseURL == "" { // path style url of the bucket
+		scheme := "http"
+		if c.S3UseSSL {
+			scheme = "https"
+		}
+		baseURL = fmt.Sprintf("%s://%s/%s", scheme, c.S3Endpoint, c.S3Bucket)
+	}
+	return &S3Store{client: client, bucket: c.S3Bucket, baseURL: strings.TrimSuffix(baseURL, "/") + "/"}, nil
+}
+
+//Put - ...
+func (s *S3Store) Put(ctx context.Context, name string, data []byte, contentType string) error {
+	_, err := s.client.PutObject(ctx, s.bucket, name, bytes.NewReader(data), int64(len(data)), minio.PutObjectOptions{ContentType: contentType})
+	return err
+}
+
+//Get - ...
+func (s *S3Store) Get(ctx context.Context, name string) ([]byte, error) {
+	obj, err := s.client.GetObject(ctx, s.bucket, name, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	defer obj.Close()
+	return ioutil.ReadAll(obj)
+}
+
+//Delete - ...
+func (s *S3Store) Delete(ctx context.Context, name string) error {
+	return s.client.RemoveObject(ctx, s.bucket, name, minio.RemoveObjectOptions{})
+}
+
+//URL - ...
+func (s *S3Store) URL(name string) string {
+	return s.baseURL + name
+}
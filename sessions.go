@@ -0,0 +1,314 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/gorilla/mux"
+	"github.com/segmentio/ksuid"
+	log "github.com/sirupsen/logrus"
+)
+
+/*Session - a login of a user in a device, lives while its refresh token does
+* All the tokens issued to a session are a family, reusing a rotated refresh token revokes the whole session
+* Saved in the tokens Redis as the hash "session:<id>", the set "user_sessions:<uid>" indexes the sessions of each user
+ */
+type Session struct {
+	ID          string    `json:"id"`
+	UID         string    `json:"-"`
+	Device      string    `json:"device"`
+	UserAgent   string    `json:"user_agent"`
+	IP          string    `json:"ip"`
+	CreatedAt   time.Time `json:"created_at"`
+	LastUsedAt  time.Time `json:"last_used_at"`
+	Current     bool      `json:"current"` // the session making the request
+	accessUUID  string
+	refreshUUID string
+}
+
+var errSessionNotFound = errors.New("Session not found")
+
+/*newSession - session for a login made by req
+* device is the name the app gave to the device, the user agent is used if it is empty
+ */
+func newSession(req *http.Request, uid string, device string) *Session {
+	now := time.Now()
+	s := &Session{
+		ID:         "s" + ksuid.New().String(),
+		UID:        uid,
+		Device:     device,
+		UserAgent:  req.UserAgent(),
+		IP:         clientIP(req),
+		CreatedAt:  now,
+		LastUsedAt: now,
+	}
+	if s.Device == "" {
+		s.Device = s.UserAgent
+	}
+	return s
+}
+
+/*clientIP - address of the client that made req
+* X-Forwarded-For is only trusted when config.TrustProxy is set, otherwise anyone could choose their IP
+ */
+func clientIP(req *http.Request) string {
+	if config.TrustProxy {
+		if fwd := req.Header.Get("X-Forwarded-For"); fwd != "" {
+			return strings.TrimSpace(strings.Split(fwd, ",")[0])
+		}
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+func sessionKey(sid string) string {
+	return "session:" + sid
+}
+
+func userSessionsKey(uid string) string {
+	return "user_sessions:" + uid
+}
+
+/*storeSession - saves the session with the tokens it has now and adds it to the index of the user
+* Both live as long as the refresh token
+ */
+func storeSession(ctx context.Context, s *Session, ttl time.Duration) error {
+	key := sessionKey(s.ID)
+	err := tokensClient.HSet(ctx, key, map[string]interface{}{
+		"uid":          s.UID,
+		"device":       s.Device,
+		"user_agent":   s.UserAgent,
+		"ip":           s.IP,
+		"created_at":   s.CreatedAt.Unix(),
+		"last_used_at": s.LastUsedAt.Unix(),
+		"access_uuid":  s.accessUUID,
+		"refresh_uuid": s.refreshUUID,
+	}).Err()
+	if err != nil {
+		return err
+	}
+	tokensClient.Expire(ctx, key, ttl)
+
+	userKey := userSessionsKey(s.UID)
+	if err = tokensClient.SAdd(ctx, userKey, s.ID).Err(); err != nil {
+		return err
+	}
+	// the index must outlive its newest session
+	if cur, _ := tokensClient.TTL(ctx, userKey).Result(); cur < ttl {
+		tokensClient.Expire(ctx, userKey, ttl)
+	}
+	return nil
+}
+
+/*getSession - session sid, errSessionNotFound if it expired or belongs to another user
+* Pass an empty uid to skip the owner check
+ */
+func getSession(ctx context.Context, uid string, sid string) (*Session, error) {
+	fields, err := tokensClient.HGetAll(ctx, sessionKey(sid)).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) == 0 || (uid != "" && fields["uid"] != uid) {
+		return nil, errSessionNotFound
+	}
+	created, _ := strconv.ParseInt(fields["created_at"], 10, 64)
+	lastUsed, _ := strconv.ParseInt(fields["last_used_at"], 10, 64)
+	return &Session{
+		ID:          sid,
+		UID:         fields["uid"],
+		Device:      fields["device"],
+		UserAgent:   fields["user_agent"],
+		IP:          fields["ip"],
+		CreatedAt:   time.Unix(created, 0),
+		LastUsedAt:  time.Unix(lastUsed, 0),
+		accessUUID:  fields["access_uuid"],
+		refreshUUID: fields["refresh_uuid"],
+	}, nil
+}
+
+//touchSession - records that the session was just used
+func touchSession(ctx context.Context, sid string, ip string) {
+	tokensClient.HSet(ctx, sessionKey(sid), "last_used_at", time.Now().Unix(), "ip", ip)
+}
+
+/*ListSessions - active sessions of the user, most recently used first
+* Sessions that expired are removed from the index on the way
+ */
+func ListSessions(uid string) ([]*Session, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	userKey := userSessionsKey(uid)
+	sids, err := tokensClient.SMembers(ctx, userKey).Result()
+	if err != nil {
+		return nil, err
+	}
+	sessions := []*Session{}
+	for _, sid := range sids {
+		s, err := getSession(ctx, uid, sid)
+		if err == errSessionNotFound {
+			tokensClient.SRem(ctx, userKey, sid)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, s)
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].LastUsedAt.After(sessions[j].LastUsedAt)
+	})
+	return sessions, nil
+}
+
+/*RevokeSession - logs out the session, deleting its tokens
+*
+ */
+func RevokeSession(uid string, sid string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	return revokeSession(ctx, uid, sid)
+}
+
+func revokeSession(ctx context.Context, uid string, sid string) error {
+	s, err := getSession(ctx, uid, sid)
+	if err != nil {
+		return err
+	}
+	err = tokensClient.Del(ctx, s.accessUUID, s.refreshUUID, sessionKey(sid)).Err()
+	if err != nil {
+		return err
+	}
+	return tokensClient.SRem(ctx, userSessionsKey(uid), sid).Err()
+}
+
+/*rotateRefresh - deletes refreshUUID and remembers that it was exchanged for new tokens of session sid, in one transaction
+* so the marker is there before anything else can fail. Returns whether the token still existed and, if it did not,
+* the session of the rotation that already used it ("" when it just expired or was revoked)
+ */
+func rotateRefresh(ctx context.Context, refreshUUID string, sid string, ttl time.Duration) (bool, string, error) {
+	if ttl < time.Second { // the token expires about now, but 0 would keep the marker forever
+		ttl = time.Second
+	}
+	var rotated *redis.StringCmd
+	var deleted *redis.IntCmd
+	_, err := tokensClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		rotated = pipe.Get(ctx, "rotated:"+refreshUUID)
+		deleted = pipe.Del(ctx, refreshUUID)
+		pipe.SetNX(ctx, "rotated:"+refreshUUID, sid, ttl) // an earlier rotation keeps its session
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return false, "", err
+	}
+	if deleted.Val() == 1 {
+		return true, "", nil
+	}
+	return false, rotated.Val(), nil
+}
+
+/*RevokeAllTokens - logs out every session of the user
+*
+ */
+func RevokeAllTokens(uid string) error {
+	return RevokeOtherTokens(uid, "")
+}
+
+/*RevokeOtherTokens - logs out every session of the user except keepSID
+*
+ */
+func RevokeOtherTokens(uid string, keepSID string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	sids, err := tokensClient.SMembers(ctx, userSessionsKey(uid)).Result()
+	if err != nil {
+		return err
+	}
+	for _, sid := range sids {
+		if sid == keepSID {
+			continue
+		}
+		err = revokeSession(ctx, uid, sid)
+		if err == errSessionNotFound { // expired, only the index entry is left
+			err = tokensClient.SRem(ctx, userSessionsKey(uid), sid).Err()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*userListSessions - lists the sessions of the logged in user
+*
+ */
+func userListSessions(req *http.Request) Response {
+	tokenAuth, err := ExtractTokenMetadata(req)
+	if err != nil {
+		return Response{Error: true, Msg: err.Error()}
+	}
+	sessions, err := ListSessions(tokenAuth.UID)
+	if err != nil {
+		return Response{Error: true, Msg: "An error occurred, please try again"}
+	}
+	for _, s := range sessions {
+		s.Current = s.ID == tokenAuth.SessionID
+	}
+	sessionsJSON, err := json.Marshal(sessions)
+	if err != nil {
+		return Response{Error: true, Msg: "error processing information"}
+	}
+	return Response{Error: false, Data: sessionsJSON}
+}
+
+/*userRevokeSession - logs out one of the sessions of the logged in user, can be the current one
+*
+ */
+func userRevokeSession(req *http.Request) Response {
+	tokenAuth, err := ExtractTokenMetadata(req)
+	if err != nil {
+		return Response{Error: true, Msg: err.Error()}
+	}
+	sid := mux.Vars(req)["id"]
+	err = RevokeSession(tokenAuth.UID, sid)
+	if err == errSessionNotFound {
+		return Response{Error: true, Msg: err.Error()}
+	}
+	if err != nil {
+		return Response{Error: true, Msg: "An error occurred, please try again"}
+	}
+	log.WithFields(log.Fields{
+		"uid": tokenAuth.UID, "sid": sid,
+	}).Info("Session revoked")
+	return Response{Error: false, Msg: "Session logged out"}
+}
+
+/*userLogoutAll - logs out every session of the logged in user, the current one included
+*
+ */
+func userLogoutAll(req *http.Request) Response {
+	tokenAuth, err := ExtractTokenMetadata(req)
+	if err != nil {
+		return Response{Error: true, Msg: err.Error()}
+	}
+	if RevokeAllTokens(tokenAuth.UID) != nil {
+		return Response{Error: true, Msg: "An error occurred, please try again"}
+	}
+	log.WithFields(log.Fields{
+		"uid": tokenAuth.UID,
+	}).Info("Logged out everywhere")
+	return Response{Error: false, Msg: "Successfully logged out of every session"}
+}
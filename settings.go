@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+/*UserSettings - choices of the user about who can see and reach it, saved in the user document
+* The zero value of every field is the default, so users that never changed them need no migration
+ */
+type UserSettings struct {
+	FriendRequests    string `json:"friend_requests" bson:"friend_requests,omitempty"`       // everyone, friends_of_friends or nobody
+	HideProfile       bool   `json:"hide_profile" bson:"hide_profile"`                       // not discoverable, only friends see the profile
+	DefaultVisibility string `json:"default_visibility" bson:"default_visibility,omitempty"` // of new messages, public or friends
+	DisableLocation   bool   `json:"disable_location" bson:"disable_location"`               // the location of the user is not stored
+	HideLastSeen      bool   `json:"hide_last_seen" bson:"hide_last_seen"`                   // from friends, nobody else sees it
+	HideMutualFriends bool   `json:"hide_mutual_friends" bson:"hide_mutual_friends"`         // from friends, nobody else sees them
+}
+
+//SettingsPatch - body of PATCH /users/me/settings, only the fields sent are changed
+type SettingsPatch struct {
+	FriendRequests    *string `json:"friend_requests" validate:"omitempty,oneof=everyone friends_of_friends nobody"`
+	HideProfile       *bool   `json:"hide_profile"`
+	DefaultVisibility *string `json:"default_visibility" validate:"omitempty,oneof=public friends"`
+	DisableLocation   *bool   `json:"disable_location"`
+	HideLastSeen      *bool   `json:"hide_last_seen"`
+	HideMutualFriends *bool   `json:"hide_mutual_friends"`
+}
+
+//withDefaults - the settings with the defaults written out, as shown to the user
+func (s UserSettings) withDefaults() UserSettings {
+	if s.FriendRequests == "" {
+		s.FriendRequests = "everyone"
+	}
+	if s.DefaultVisibility == "" {
+		s.DefaultVisibility = "public"
+	}
+	return s
+}
+
+/*userGetSettings - settings of the logged in user
+*
+ */
+func userGetSettings(req *http.Request) Response {
+	tokenAuth, err := ExtractTokenMetadata(req)
+	if err != nil {
+		return Response{Error: true, Msg: err.Error()}
+	}
+	settings, err := DBGetSettings(tokenAuth.UID)
+	if err != nil {
+		return Response{Error: true, Msg: "DB Error"}
+	}
+	settingsJSON, err := json.Marshal(settings.withDefaults())
+	if err != nil {
+		return Response{Error: true, Msg: "error processing information"}
+	}
+	return Response{Error: false, Data: settingsJSON}
+}
+
+/*userPatchSettings - changes the settings sent, returns all of them
+* Turning the location off also forgets the stored one
+ */
+func userPatchSettings(req *http.Request) Response {
+	tokenAuth, err := ExtractTokenMetadata(req)
+	if err != nil {
+		return Response{Error: true, Msg: err.Error()}
+	}
+	var data SettingsPatch
+	decoder := json.NewDecoder(req.Body)
+	decoder.DisallowUnknownFields()
+	if err = decoder.Decode(&data); err != nil {
+		return Response{Error: true, Msg: "Invalid request"}
+	}
+	if !_validateInput(data) {
+		return Response{Error: true, Msg: "Invalid settings"}
+	}
+
+	set := bson.M{}
+	fields := map[string]interface{}{
+		"friend_requests":     data.FriendRequests,
+		"hide_profile":        data.HideProfile,
+		"default_visibility":  data.DefaultVisibility,
+		"disable_location":    data.DisableLocation,
+		"hide_last_seen":      data.HideLastSeen,
+		"hide_mutual_friends": data.HideMutualFriends,
+	}
+	for name, val := range fields {
+		switch v := val.(type) {
+		case *string:
+			if v != nil {
+				set["settings."+name] = *v
+			}
+		case *bool:
+			if v != nil {
+				set["settings."+name] = *v
+			}
+		}
+	}
+	if len(set) > 0 {
+		forgetLocation := data.DisableLocation != nil && *data.DisableLocation
+		if DBUpdateSettings(tokenAuth.UID, set, forgetLocation) != nil {
+			return Response{Error: true, Msg: "DB Error"}
+		}
+		log.WithFields(log.Fields{
+			"uid": tokenAuth.UID,
+		}).Info("Settings changed")
+	}
+	return userGetSettings(req)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"strconv"
+	"time"
+)
+
+//SMTPMailer - Mailer using any SMTP server (or MailHog when developing)
+type SMTPMailer struct {
+	addr string
+	auth smtp.Auth // nil when the server does not need authentication
+	from string
+}
+
+//NewSMTPMailer - ...
+func NewSMTPMailer(c MailConfig) *SMTPMailer {
+	m := &SMTPMailer{addr: c.SMTPHost + ":" + strconv.Itoa(c.SMTPPort), from: c.From}
+	if c.SMTPUsername != "" {
+		m.auth = smtp.PlainAuth("", c.SMTPUsername, c.SMTPPassword, c.SMTPHost)
+	}
+	return m
+}
+
+//Send - ...
+func (m *SMTPMailer) Send(ctx context.Context, e *Email) error {
+	from, err := mail.ParseAddress(m.from)
+	if err != nil {
+		return err
+	}
+	msg, err := buildMIME(m.from, e)
+	if err != nil {
+		return err
+	}
+
+	done := make(chan error, 1)
+	go func() { // smtp.SendMail has no context
+		done <- smtp.SendMail(m.addr, m.auth, from.Address, []string{e.To}, msg)
+	}()
+	select {
+	case err = <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+//buildMIME - the email as sent over SMTP, multipart/alternative when there is an HTML version
+func buildMIME(from string, e *Email) ([]byte, error) {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", from)
+	fmt.Fprintf(&buf, "To: %s\r\n", e.To)
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", e.Subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	buf.WriteString("MIME-Version: 1.0\r\n")
+
+	if e.HTML == "" {
+		buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+		buf.WriteString(e.Text)
+		return buf.Bytes(), nil
+	}
+
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	fmt.Fprintf(&buf, "Content-Type: multipart/alternative; boundary=%s\r\n\r\n", w.Boundary())
+	for _, part := range []struct{ contentType, content string }{
+		{"text/plain; charset=utf-8", e.Text},
+		{"text/html; charset=utf-8", e.HTML},
+	} {
+		pw, err := w.CreatePart(textproto.MIMEHeader{"Content-Type": {part.contentType}})
+		if err != nil {
+			return nil, err
+		}
+		pw.Write([]byte(part.content))
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	buf.Write(body.Bytes())
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"path"
+	"time"
+
+	"github.com/segmentio/ksuid"
+	log "github.com/sirupsen/logrus"
+)
+
+/*BlobStore - where images are stored. Blobs are identified by name, URL is the public link to one
+* Deleting a blob that does not exist is not an error, so deletions can be retried
+ */
+type BlobStore interface {
+	Put(ctx context.Context, name string, data []byte, contentType string) error
+	Get(ctx context.Context, name string) ([]byte, error)
+	Delete(ctx context.Context, name string) error
+	URL(name string) string
+}
+
+var blobStore BlobStore = NewBlobStore(config.Storage)
+
+/*NewBlobStore - the BlobStore of the configured backend
+*
+ */
+func NewBlobStore(c StorageConfig) BlobStore {
+	var store BlobStore
+	var err error
+	switch c.Backend {
+	case "azure":
+		store, err = NewAzureStore(c)
+	case "local":
+		store, err = NewLocalStore(c)
+	case "s3":
+		store, err = NewS3Store(c)
+	default:
+		err = fmt.Errorf("unknown storage backend %q", c.Backend)
+	}
+	if err != nil {
+		fmt.Println("error creating blob store")
+		log.Fatal(err)
+	}
+	return store
+}
+
+//GetBlobName - dd
+func GetBlobName() string {
+	uuid := ksuid.New().String()
+	return "i" + uuid
+	//return fmt.Sprintf("%s-%v.jpg", t.Format("20060102"), uuid)
+}
+
+//uploadImage - stores a jpeg with a new name and returns its URL
+func uploadImage(data []byte) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	name := GetBlobName()
+	if err := blobStore.Put(ctx, name, data, "image/jpeg"); err != nil {
+		return "", err
+	}
+	return blobStore.URL(name), nil
+}
+
+//deleteImage - deletes an image given its URL, as returned by uploadImage
+func deleteImage(imageURL string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	return blobStore.Delete(ctx, path.Base(imageURL))
+}
+
+func b64ToJpeg(b64Image string) image.Image {
+	unbased, _ := base64.StdEncoding.DecodeString(b64Image)
+	res := bytes.NewReader(unbased)
+	image, err := jpeg.Decode(res)
+	if err != nil {
+		fmt.Println("error converting to jpeg")
+	}
+	return image
+}
+
+//JpegToBytes - dd
+func JpegToBytes(nImage image.Image) []byte {
+	buf := new(bytes.Buffer)
+	err := jpeg.Encode(buf, nImage, nil)
+	if err != nil {
+		fmt.Println("error transforming image")
+	}
+	return buf.Bytes()
+}
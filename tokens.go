@@ -4,13 +4,12 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
-	"fmt"
 	"net/http"
-	"os"
 	"strings"
 	"time"
 
-	"github.com/dgrijalva/jwt-go"
+	"github.com/golang-jwt/jwt/v4"
+	log "github.com/sirupsen/logrus"
 	"github.com/twinj/uuid"
 )
 
@@ -28,51 +27,50 @@ type TokenDetails struct {
 type AccessDetails struct {
 	AccessUUID string
 	UID        string
+	SessionID  string
 }
 
 /*CreateTokens - creates
-*
+* The tokens belong to the session s, which is saved with them
 *
 *
  */
-func CreateTokens(uid string) (*TokenDetails, error) {
-	//TODO - increased time from 15min / 24hours to 60min /30days to ease testing
+func CreateTokens(s *Session) (*TokenDetails, error) {
+	uid := s.UID
 	var err error
 	td := &TokenDetails{}
 	// Access Token
-	td.AtExpires = time.Now().Add(time.Minute * 60).Unix()
+	td.AtExpires = time.Now().Add(config.AccessLifetime).Unix()
 	td.AccessUUID = uuid.NewV4().String()
 	// Refresh Token
-	td.RtExpires = time.Now().Add(time.Hour * 24 * 30).Unix()
+	td.RtExpires = time.Now().Add(config.RefreshLifetime).Unix()
 	td.RefreshUUID = uuid.NewV4().String()
 
 	// Creating Access Token
-	os.Setenv("ACCESS_SECRET", "SECRET") // This should be in an env file!!!!!
 	atClaims := jwt.MapClaims{}
 	atClaims["authorized"] = true
 	atClaims["access_uuid"] = td.AccessUUID
 	atClaims["uid"] = uid
+	atClaims["sid"] = s.ID
 	atClaims["exp"] = td.AtExpires
-	at := jwt.NewWithClaims(jwt.SigningMethodHS256, atClaims)
-	td.AccessToken, err = at.SignedString([]byte(os.Getenv("ACCESS_SECRET")))
+	td.AccessToken, err = keyring.Sign(atClaims)
 	if err != nil {
 		return nil, err
 	}
 
 	// Creating Refresh Token
-	os.Setenv("REFRESH_SECRET", "SECRET") // This should be in an env file!!!!!
 	rtClaims := jwt.MapClaims{}
 	rtClaims["refresh_uuid"] = td.RefreshUUID
 	rtClaims["uid"] = uid
+	rtClaims["sid"] = s.ID
 	rtClaims["exp"] = td.RtExpires
-	rt := jwt.NewWithClaims(jwt.SigningMethodHS256, rtClaims)
-	td.RefreshToken, err = rt.SignedString([]byte(os.Getenv("REFRESH_SECRET")))
+	td.RefreshToken, err = keyring.Sign(rtClaims)
 	if err != nil {
 		return nil, err
 	}
 
 	// Store both UUIDs in Redis
-	err = StoreTokens(uid, td)
+	err = StoreTokens(s, td)
 	if err != nil {
 		return nil, err
 	}
@@ -86,7 +84,7 @@ func CreateTokens(uid string) (*TokenDetails, error) {
 *
 *
  */
-func StoreTokens(uid string, td *TokenDetails) error {
+func StoreTokens(s *Session, td *TokenDetails) error {
 
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
@@ -102,10 +100,18 @@ func StoreTokens(uid string, td *TokenDetails) error {
 		return errAccess
 	}
 	// Insert RefreshUUID into Redis
-	errRefresh := tokensClient.Set(ctx, td.RefreshUUID, uid, rt.Sub(now)).Err()
+	errRefresh := tokensClient.Set(ctx, td.RefreshUUID, s.UID, rt.Sub(now)).Err()
 	if errRefresh != nil {
 		return errRefresh
 	}
+	// Save the session with its new tokens
+	s.accessUUID = td.AccessUUID
+	s.refreshUUID = td.RefreshUUID
+	s.LastUsedAt = now
+	errSession := storeSession(ctx, s, rt.Sub(now))
+	if errSession != nil {
+		return errSession
+	}
 	// Success
 	return nil
 }
@@ -149,33 +155,41 @@ func ExtractTokenMetadata(r *http.Request) (*AccessDetails, error) {
 		if err != nil {
 			return nil, errors.New("Access token expired")
 		}
+		sid, _ := claims["sid"].(string)
+		if sid != "" {
+			touchSession(ctx, sid, clientIP(r))
+		}
 		// Success
 		return &AccessDetails{
 			AccessUUID: accessUUID,
 			UID:        uid,
+			SessionID:  sid,
 		}, nil
 	}
 	return nil, errors.New("Invalid token")
 }
 
 /*ParseToken - parse
-*
-*
+* tokenType is ACCESS_TOKEN or REFRESH_TOKEN, both are signed by the keyring so the type is told by the uuid claim
+* The verification key is chosen by the kid in the header
 *
  */
 func ParseToken(r *http.Request, tokenType string) (*jwt.Token, error) {
 	// Extract token string
 	tokenString := ExtractToken(r)
 	// Verify the token
-	os.Setenv(tokenType, "SECRET") // This should be in an env file!!!!!
-	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		// Make sure that the token method conform to "SigningMethodHMAC"
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-		}
-		return []byte(os.Getenv(tokenType)), nil
-	})
-	return token, err
+	uuidClaim := "access_uuid"
+	if tokenType == "REFRESH_TOKEN" {
+		uuidClaim = "refresh_uuid"
+	}
+	token, err := jwt.Parse(tokenString, keyring.Keyfunc)
+	if err != nil {
+		return token, err
+	}
+	if claims, ok := token.Claims.(jwt.MapClaims); !ok || claims[uuidClaim] == nil {
+		return nil, errors.New("token is not a " + strings.ToLower(tokenType))
+	}
+	return token, nil
 }
 
 /*ExtractToken - does
@@ -236,13 +250,13 @@ func Logout(accessUUID string) (int64, error) {
 }
 
 /*RefreshToken - ref
-*
+* Every refresh token is single use, the tokens of a session form a family that is revoked when an old one is reused
 *
 *
  */
 func RefreshToken(r *http.Request) Response {
 	// Parse refresh token
-	token, err := ParseToken(r, "REFRESS_TOKEN")
+	token, err := ParseToken(r, "REFRESH_TOKEN")
 
 	// Verify token parsing error
 	if err != nil || token == nil {
@@ -266,13 +280,45 @@ func RefreshToken(r *http.Request) Response {
 		if !ok {
 			return Response{Error: true, Msg: "Invalid token"}
 		}
-		// Delete the previous Refresh Token
-		deleted, delErr := DeleteAuth(refreshUUID)
-		if delErr != nil || deleted == 0 {
+		sid, _ := claims["sid"].(string)
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		// Keep the session, tokens from before sessions existed get a new one
+		session := newSession(r, uid, "")
+		family := sid
+		if family == "" {
+			family = session.ID
+		}
+		// Delete the previous Refresh Token and remember it until it expires, to recognize it if it shows up again
+		ttl := config.RefreshLifetime
+		if exp, ok := claims["exp"].(float64); ok {
+			ttl = time.Until(time.Unix(int64(exp), 0))
+		}
+		existed, reusedFamily, err := rotateRefresh(ctx, refreshUUID, family, ttl)
+		if err != nil {
+			return Response{Error: true, Msg: "An error occurred"}
+		}
+		if !existed {
+			// A token that was already rotated means that someone else has a copy of it
+			if reusedFamily != "" {
+				log.WithFields(log.Fields{
+					"uid": uid, "sid": reusedFamily, "ip": clientIP(r),
+				}).Warn("Rotated refresh token reused, revoking its session")
+				RevokeSession(uid, reusedFamily)
+			}
 			return Response{Error: true, Msg: "Refresh token expired"}
 		}
+		if sid != "" {
+			s, err := getSession(ctx, uid, sid)
+			if err != nil {
+				return Response{Error: true, Msg: "Refresh token expired"}
+			}
+			DeleteAuth(s.accessUUID) // the previous access token dies with its refresh token
+			s.IP = clientIP(r)
+			session = s
+		}
 		// Create new pairs of refresh and access tokens
-		td, createErr := CreateTokens(uid)
+		td, createErr := CreateTokens(session)
 		if createErr != nil {
 			return Response{Error: true, Msg: "An error occurred"}
 		}
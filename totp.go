@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	log "github.com/sirupsen/logrus"
+	"github.com/twinj/uuid"
+	"golang.org/x/crypto/bcrypt"
+
+	"mappin-server/totp"
+)
+
+//TOTPInfo - two factor authentication state of a user
+type TOTPInfo struct {
+	Enabled       bool     `bson:"totp_enabled"`
+	Secret        string   `bson:"totp_secret"`
+	PendingSecret string   `bson:"totp_pending_secret"` // enrolled but not verified yet
+	LastStep      int64    `bson:"totp_last_step"`      // a code can't be used twice
+	RecoveryCodes []string `bson:"recovery_codes"`      // sha256 of the unused codes
+}
+
+//TOTPCode - body of the requests that confirm a TOTP code
+type TOTPCode struct {
+	Code     string `json:"code" validate:"required,len=6,numeric"`
+	Password string `json:"password"` // only needed to disable
+}
+
+//MFALogin - second step of a login with two factor authentication, with a TOTP or a recovery code
+type MFALogin struct {
+	MFAToken     string `json:"mfa_token" validate:"required"`
+	Code         string `json:"code" validate:"omitempty,len=6,numeric"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+const (
+	mfaTokenLifetime = 5 * time.Minute
+	mfaMaxAttempts   = 5
+)
+
+//clock - current time, a variable so the TOTP checks can run with a fake clock
+var clock = time.Now
+
+//mongoTOTPStore - keeps the used time steps and recovery codes in the users collection
+type mongoTOTPStore struct{}
+
+func (mongoTOTPStore) UseStep(UID string, step int64) error {
+	return DBUseTOTPStep(UID, step)
+}
+
+func (mongoTOTPStore) UseRecoveryCode(UID string, hash string) error {
+	return DBUseRecoveryCode(UID, hash)
+}
+
+var totpStore totp.Store = mongoTOTPStore{}
+
+/*userEnrollTOTP - starts the two factor authentication setup of the logged in user
+* Returns the secret and the otpauth URI, 2FA is only on after userVerifyTOTP
+ */
+func userEnrollTOTP(req *http.Request) Response {
+	tokenAuth, err := ExtractTokenMetadata(req)
+	if err != nil {
+		return Response{Error: true, Msg: err.Error()}
+	}
+	info, err := DBGetTOTP(tokenAuth.UID)
+	if err != nil {
+		return Response{Error: true, Msg: "DB Error"}
+	}
+	if info.Enabled {
+		return Response{Error: true, Msg: "Two factor authentication is already on"}
+	}
+	u, err := DBGetUser(tokenAuth.UID)
+	if err != nil {
+		return Response{Error: true, Msg: "DB Error"}
+	}
+
+	key := make([]byte, 20)
+	if _, err = rand.Read(key); err != nil {
+		return Response{Error: true, Msg: "An error occurred, please try again"}
+	}
+	secret := totp.Encoding.EncodeToString(key)
+	if DBSetPendingTOTP(tokenAuth.UID, secret) != nil {
+		return Response{Error: true, Msg: "DB Error"}
+	}
+	enrollJSON, err := json.Marshal(map[string]string{"secret": secret, "uri": totp.URI(u.Email, secret)})
+	if err != nil {
+		return Response{Error: true, Msg: "error processing information"}
+	}
+	return Response{Error: false, Data: enrollJSON}
+}
+
+/*userVerifyTOTP - turns two factor authentication on once the user shows a code of the enrolled secret
+* Returns the recovery codes, which are not shown again
+ */
+func userVerifyTOTP(req *http.Request) Response {
+	tokenAuth, err := ExtractTokenMetadata(req)
+	if err != nil {
+		return Response{Error: true, Msg: err.Error()}
+	}
+	var data TOTPCode
+	decoder := json.NewDecoder(req.Body)
+	if err = decoder.Decode(&data); err != nil {
+		return Response{Error: true, Msg: "Invalid request"}
+	}
+	if !_validateInput(data) {
+		return Response{Error: true, Msg: "Invalid code"}
+	}
+	info, err := DBGetTOTP(tokenAuth.UID)
+	if err != nil {
+		return Response{Error: true, Msg: "DB Error"}
+	}
+	if info.Enabled || info.PendingSecret == "" {
+		return Response{Error: true, Msg: "Start the two factor authentication setup first"}
+	}
+	step := totp.Check(info.PendingSecret, data.Code, clock())
+	if step == 0 {
+		return Response{Error: true, Msg: "Invalid code"}
+	}
+
+	codes, hashes, err := totp.NewRecoveryCodes()
+	if err != nil {
+		return Response{Error: true, Msg: "An error occurred, please try again"}
+	}
+	if DBEnableTOTP(tokenAuth.UID, info.PendingSecret, step, hashes) != nil {
+		return Response{Error: true, Msg: "DB Error"}
+	}
+	log.WithFields(log.Fields{
+		"uid": tokenAuth.UID,
+	}).Info("Two factor authentication on")
+	codesJSON, err := json.Marshal(map[string][]string{"recovery_codes": codes})
+	if err != nil {
+		return Response{Error: true, Msg: "error processing information"}
+	}
+	return Response{Error: false, Data: codesJSON}
+}
+
+/*userDisableTOTP - turns two factor authentication off, needs the password and a current code
+*
+ */
+func userDisableTOTP(req *http.Request) Response {
+	tokenAuth, err := ExtractTokenMetadata(req)
+	if err != nil {
+		return Response{Error: true, Msg: err.Error()}
+	}
+	var data TOTPCode
+	decoder := json.NewDecoder(req.Body)
+	if err = decoder.Decode(&data); err != nil {
+		return Response{Error: true, Msg: "Invalid request"}
+	}
+	if !_validateInput(data) {
+		return Response{Error: true, Msg: "Invalid code"}
+	}
+	hashedPassword, err := DBGetPasswordHash(tokenAuth.UID)
+	if err != nil {
+		return Response{Error: true, Msg: "DB Error"}
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(data.Password)) != nil {
+		return Response{Error: true, Msg: "Password is wrong"}
+	}
+	info, err := DBGetTOTP(tokenAuth.UID)
+	if err != nil {
+		return Response{Error: true, Msg: "DB Error"}
+	}
+	if !info.Enabled {
+		return Response{Error: true, Msg: "Two factor authentication is already off"}
+	}
+	if !totp.Use(totpStore, tokenAuth.UID, info.Secret, info.LastStep, data.Code, clock()) {
+		return Response{Error: true, Msg: "Invalid code"}
+	}
+	if DBDisableTOTP(tokenAuth.UID) != nil {
+		return Response{Error: true, Msg: "DB Error"}
+	}
+	log.WithFields(log.Fields{
+		"uid": tokenAuth.UID,
+	}).Info("Two factor authentication off")
+	return Response{Error: false, Msg: "Two factor authentication is off"}
+}
+
+/*mfaChallenge - answer to a correct password when the user has 2FA on
+* The mfa_pending token is short lived and is exchanged for the real tokens in userLoginMFA, the email is kept for the lockout counters
+ */
+func mfaChallenge(UID string, email string, device string) Response {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	mfaUUID := uuid.NewV4().String()
+	err := tokensClient.HSet(ctx, "mfa:"+mfaUUID, "uid", UID, "email", email, "device", device, "attempts", 0).Err()
+	if err != nil {
+		return Response{Error: true, Msg: "An error occurred, please try again"}
+	}
+	tokensClient.Expire(ctx, "mfa:"+mfaUUID, mfaTokenLifetime)
+
+	claims := jwt.MapClaims{}
+	claims["mfa_pending"] = true
+	claims["mfa_uuid"] = mfaUUID
+	claims["uid"] = UID
+	claims["exp"] = clock().Add(mfaTokenLifetime).Unix()
+	token, err := keyring.Sign(claims)
+	if err != nil {
+		return Response{Error: true, Msg: "An error occurred, please try again"}
+	}
+	challengeJSON, err := json.Marshal(map[string]interface{}{"mfa_pending": true, "mfa_token": token})
+	if err != nil {
+		return Response{Error: true, Msg: "error processing information"}
+	}
+	return Response{Error: false, Msg: "Two factor authentication code required", Data: challengeJSON}
+}
+
+/*userLoginMFA - exchanges an mfa_pending token and a TOTP or recovery code for access and refresh tokens
+*
+ */
+func userLoginMFA(req *http.Request) Response {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var data MFALogin
+	decoder := json.NewDecoder(req.Body)
+	if err := decoder.Decode(&data); err != nil {
+		return Response{Error: true, Msg: "Invalid request"}
+	}
+	if !_validateInput(data) || (data.Code == "") == (data.RecoveryCode == "") {
+		return Response{Error: true, Msg: "Send either a code or a recovery code"}
+	}
+
+	token, err := jwt.Parse(data.MFAToken, keyring.Keyfunc)
+	if err != nil {
+		return Response{Error: true, Msg: "Invalid or expired token, log in again"}
+	}
+	claims, _ := token.Claims.(jwt.MapClaims)
+	mfaUUID, ok := claims["mfa_uuid"].(string)
+	if !ok {
+		return Response{Error: true, Msg: "Invalid token"}
+	}
+	key := "mfa:" + mfaUUID
+	pending, err := tokensClient.HGetAll(ctx, key).Result()
+	if err != nil || len(pending) == 0 {
+		return Response{Error: true, Msg: "Invalid or expired token, log in again"}
+	}
+	UID, email, ip := pending["uid"], pending["email"], clientIP(req)
+	if wait := loginWait(ctx, email, ip); wait > 0 {
+		return Response{Error: true, Msg: fmt.Sprintf("Too many failed attempts, try again in %d seconds", int(math.Ceil(wait.Seconds())))}
+	}
+	if attempts, err := tokensClient.HIncrBy(ctx, key, "attempts", 1).Result(); err != nil || attempts > mfaMaxAttempts {
+		tokensClient.Del(ctx, key)
+		return Response{Error: true, Msg: "Too many attempts, log in again"}
+	}
+
+	info, err := DBGetTOTP(UID)
+	if err != nil {
+		return Response{Error: true, Msg: "DB Error"}
+	}
+	if data.Code != "" {
+		ok = totp.Use(totpStore, UID, info.Secret, info.LastStep, data.Code, clock())
+	} else {
+		ok = totp.UseRecoveryCode(totpStore, UID, data.RecoveryCode)
+	}
+	if !ok {
+		log.WithFields(log.Fields{
+			"uid": UID, "ip": ip,
+		}).Info("Wrong two factor authentication code")
+		// counted like a wrong password, so guessing codes over many mfa tokens locks the account too
+		loginFailed(ctx, email, ip, UID)
+		return Response{Error: true, Msg: "Invalid code"}
+	}
+	// the token is single use
+	if deleted, err := tokensClient.Del(ctx, key).Result(); err != nil || deleted == 0 {
+		return Response{Error: true, Msg: "Invalid or expired token, log in again"}
+	}
+	if data.RecoveryCode != "" {
+		log.WithFields(log.Fields{
+			"uid": UID,
+		}).Info("Recovery code used")
+	}
+	res := loginTokens(req, UID, pending["device"])
+	if !res.Error {
+		loginSucceeded(ctx, email)
+	}
+	return res
+}
@@ -0,0 +1,119 @@
+//Package totp - RFC 6238 codes and recovery codes of the two factor authentication, with no DB or config so it can be tested alone
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	Issuer             = "Mappin"
+	Period             = 30 // seconds
+	Digits             = 6
+	Skew               = 1 // steps accepted before and after the current one, for clock drift
+	RecoveryCodesCount = 10
+)
+
+//Encoding - how secrets are stored and shown to the user
+var Encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+/*Store - where the used time steps and the unused recovery codes are kept
+* Both calls must fail when the step or code can't be used, even if two requests race
+ */
+type Store interface {
+	UseStep(UID string, step int64) error          // fails if the same or a later step was already used
+	UseRecoveryCode(UID string, hash string) error // fails if no unused recovery code has this hash
+}
+
+/*Code - RFC 6238 code of the secret at time step
+*
+ */
+func Code(secret []byte, step int64) string {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", Digits, value%1000000)
+}
+
+/*Check - time step in which code is valid for the base32 secret at now, 0 if it is not valid
+*
+ */
+func Check(secret string, code string, now time.Time) int64 {
+	key, err := Encoding.DecodeString(secret)
+	if err != nil {
+		return 0
+	}
+	current := now.Unix() / Period
+	for step := current - Skew; step <= current+Skew; step++ {
+		if subtle.ConstantTimeCompare([]byte(Code(key, step)), []byte(code)) == 1 {
+			return step
+		}
+	}
+	return 0
+}
+
+/*Use - checks the code and marks its time step as used, so the same code can't log in twice
+* lastStep may be stale, the store has the final word
+ */
+func Use(s Store, UID string, secret string, lastStep int64, code string, now time.Time) bool {
+	step := Check(secret, code, now)
+	if step == 0 || step <= lastStep {
+		return false
+	}
+	return s.UseStep(UID, step) == nil
+}
+
+//UseRecoveryCode - removes the recovery code from the store, false if it was already used or never existed
+func UseRecoveryCode(s Store, UID string, code string) bool {
+	return s.UseRecoveryCode(UID, HashRecoveryCode(code)) == nil
+}
+
+//URI - otpauth URI that authenticator apps read from a QR code
+func URI(email string, secret string) string {
+	params := url.Values{}
+	params.Set("secret", secret)
+	params.Set("issuer", Issuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", fmt.Sprint(Digits))
+	params.Set("period", fmt.Sprint(Period))
+	return "otpauth://totp/" + url.PathEscape(Issuer+":"+email) + "?" + params.Encode()
+}
+
+/*NewRecoveryCodes - one time codes that replace a TOTP code when the device is lost
+* Returns the codes to show to the user and the hashes to store
+ */
+func NewRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, RecoveryCodesCount)
+	hashes := make([]string, RecoveryCodesCount)
+	for i := range codes {
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+		code := hex.EncodeToString(b)
+		codes[i] = code[:5] + "-" + code[5:]
+		hashes[i] = HashRecoveryCode(code)
+	}
+	return codes, hashes, nil
+}
+
+//HashRecoveryCode - the codes are random enough that a fast hash is enough
+func HashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
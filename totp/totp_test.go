@@ -0,0 +1,148 @@
+package totp
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+//the secret of the SHA1 test vectors of RFC 6238
+var rfcSecret = []byte("12345678901234567890")
+
+var errUsed = errors.New("already used")
+
+//fakeStore - in memory Store with the same rules as the users collection
+type fakeStore struct {
+	lastStep      map[string]int64
+	recoveryCodes map[string]map[string]bool
+}
+
+func newFakeStore() *fakeStore {
+	return &fakeStore{lastStep: map[string]int64{}, recoveryCodes: map[string]map[string]bool{}}
+}
+
+func (s *fakeStore) UseStep(UID string, step int64) error {
+	if step <= s.lastStep[UID] {
+		return errUsed
+	}
+	s.lastStep[UID] = step
+	return nil
+}
+
+func (s *fakeStore) UseRecoveryCode(UID string, hash string) error {
+	if !s.recoveryCodes[UID][hash] {
+		return errUsed
+	}
+	delete(s.recoveryCodes[UID], hash)
+	return nil
+}
+
+func TestCodeRFC6238(t *testing.T) {
+	// the last 6 of the 8 digits in the RFC, the same value mod 10^6
+	vectors := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, v := range vectors {
+		if got := Code(rfcSecret, v.unix/Period); got != v.code {
+			t.Errorf("time %d: got %s, want %s", v.unix, got, v.code)
+		}
+	}
+}
+
+func TestCheckWindow(t *testing.T) {
+	secret := Encoding.EncodeToString(rfcSecret)
+	now := time.Unix(1111111109, 0)
+	current := now.Unix() / Period
+
+	for offset := int64(-Skew); offset <= Skew; offset++ {
+		code := Code(rfcSecret, current+offset)
+		if got := Check(secret, code, now); got != current+offset {
+			t.Errorf("offset %d: got step %d, want %d", offset, got, current+offset)
+		}
+	}
+	for _, offset := range []int64{-Skew - 1, Skew + 1} {
+		if got := Check(secret, Code(rfcSecret, current+offset), now); got != 0 {
+			t.Errorf("offset %d: code outside the window accepted with step %d", offset, got)
+		}
+	}
+	if got := Check(secret, "000000", now); got != 0 {
+		t.Errorf("wrong code accepted with step %d", got)
+	}
+	if got := Check("not base32!", Code(rfcSecret, current), now); got != 0 {
+		t.Errorf("invalid secret accepted with step %d", got)
+	}
+}
+
+func TestUseRejectsReplay(t *testing.T) {
+	secret := Encoding.EncodeToString(rfcSecret)
+	now := time.Unix(1111111109, 0)
+	current := now.Unix() / Period
+	code := Code(rfcSecret, current)
+	s := newFakeStore()
+
+	if !Use(s, "u1", secret, 0, code, now) {
+		t.Fatal("valid code rejected")
+	}
+	// a stale lastStep, only the store stops the second use
+	if Use(s, "u1", secret, 0, code, now) {
+		t.Fatal("code used twice")
+	}
+	if s.lastStep["u1"] != current {
+		t.Fatalf("last step is %d, want %d", s.lastStep["u1"], current)
+	}
+	if Use(s, "u1", secret, 0, Code(rfcSecret, current-1), now) {
+		t.Fatal("code older than the last used step accepted")
+	}
+	if Use(s, "u1", secret, current, code, now.Add(Period*time.Second)) {
+		t.Fatal("code of the last used step accepted with an up to date lastStep")
+	}
+	// the next step is new, and the steps of another user are apart
+	if !Use(s, "u1", secret, current, Code(rfcSecret, current+1), now.Add(Period*time.Second)) {
+		t.Fatal("code of the next step rejected")
+	}
+	if !Use(s, "u2", secret, 0, code, now) {
+		t.Fatal("code rejected for another user")
+	}
+}
+
+func TestRecoveryCodeSingleUse(t *testing.T) {
+	codes, hashes, err := NewRecoveryCodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(codes) != RecoveryCodesCount {
+		t.Fatalf("got %d recovery codes, want %d", len(codes), RecoveryCodesCount)
+	}
+	s := newFakeStore()
+	s.recoveryCodes["u1"] = map[string]bool{}
+	for _, h := range hashes {
+		s.recoveryCodes["u1"][h] = true
+	}
+
+	if !UseRecoveryCode(s, "u1", codes[0]) {
+		t.Fatal("unused recovery code rejected")
+	}
+	if UseRecoveryCode(s, "u1", codes[0]) {
+		t.Fatal("recovery code used twice")
+	}
+	if UseRecoveryCode(s, "u2", codes[1]) {
+		t.Fatal("recovery code of another user accepted")
+	}
+	// typed without the dash and in upper case it is the same code
+	typed := strings.ToUpper(strings.Replace(codes[1], "-", "", 1))
+	if !UseRecoveryCode(s, "u1", typed) {
+		t.Fatal("recovery code typed differently rejected")
+	}
+	if len(s.recoveryCodes["u1"]) != RecoveryCodesCount-2 {
+		t.Fatalf("%d recovery codes left, want %d", len(s.recoveryCodes["u1"]), RecoveryCodesCount-2)
+	}
+}
@@ -4,12 +4,13 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"io"
+	"image/jpeg"
+	"math"
 	"net/http"
-	"os"
+	"strings"
 	"time"
 
-	"github.com/mailgun/mailgun-go"
+	"github.com/go-redis/redis"
 	"github.com/segmentio/ksuid"
 	log "github.com/sirupsen/logrus"
 	"github.com/twinj/uuid"
@@ -18,23 +19,20 @@ import (
 	"gopkg.in/go-playground/validator.v9"
 )
 
-//DOMAIN - email domain
-const DOMAIN = "hadrons.xyz"
-
-//APIKEY - mailgun api key
-const APIKEY = "key"
-
 //User - a user
 type User struct {
-	UID              string `json:"uid,omitempty" bson:"uid"`
-	Username         string `json:"username" bson:"username" validate:"required,min=2,max=10"`
-	Email            string `json:"email" bson:"email" validate:"required,email"`
-	Image            string `json:"image,omitempty" bson:"image"`
-	Password         string `json:"password" bson:"password" validate:"required,min=8"` // need to add verification for password strength
-	CreatedAt        int64  `json:"created_at,omitempty" bson:"created_at"`
-	LastAccess       int64  `json:"last_access,omitempty" bson:"last_access"`
-	LastChangedName  int64  `json:"last_changed_name,omitempty" bson:"last_changed_name"`
-	ValidatedAccount bool   `json:"validated_account" bson:"validated_account"`
+	UID              string       `json:"uid,omitempty" bson:"uid"`
+	Username         string       `json:"username" bson:"username" validate:"required,min=2,max=10"`
+	Email            string       `json:"email" bson:"email" validate:"required,email"`
+	Image            string       `json:"image,omitempty" bson:"image"`
+	Password         string       `json:"password" bson:"password" validate:"required,min=8"` // need to add verification for password strength
+	CreatedAt        int64        `json:"created_at,omitempty" bson:"created_at"`
+	LastAccess       int64        `json:"last_access,omitempty" bson:"last_access"`
+	LastChangedName  int64        `json:"last_changed_name,omitempty" bson:"last_changed_name"`
+	ValidatedAccount bool         `json:"validated_account" bson:"validated_account"`
+	Settings         UserSettings `json:"settings" bson:"settings"`
+	Lang             string       `json:"-" bson:"lang"`              // language of the emails, from the last login
+	Deleted          bool         `json:"-" bson:"deleted,omitempty"` // the account is being deleted, see deletion.go
 	//email verified bool
 	// username last change date
 }
@@ -43,8 +41,27 @@ type User struct {
 type Login struct {
 	Email    string `json:"email" bson:"email" validate:"required,email"`
 	Password string `json:"password" bson:"password" validate:"required"`
+	Device   string `json:"device" bson:"-" validate:"max=64"` // name shown in the list of sessions
 }
 
+//ChangeEmail - body of a request to change the email of a logged in user
+type ChangeEmail struct {
+	NewEmail string `json:"new_email" validate:"required,email"`
+	Password string `json:"password" validate:"required"`
+}
+
+//EmailChange - pending email change, saved in codesClient until the new address is confirmed
+type EmailChange struct {
+	UID       string `json:"uid"`
+	Email     string `json:"email"`
+	SessionID string `json:"sid"` // session that asked for the change, kept when the others are logged out
+}
+
+const (
+	validationEmailInterval = time.Minute
+	validationEmailsPerHour = 5
+)
+
 // Internal
 
 /*_validateInput - auxiliar function to validate structure
@@ -52,7 +69,6 @@ type Login struct {
  */
 func _validateInput(s interface{}) bool {
 	v := validator.New()
-	fmt.Println(s)
 	err := v.Struct(s)
 	if err != nil {
 		for _, e := range err.(validator.ValidationErrors) {
@@ -75,48 +91,79 @@ func userLogin(req *http.Request) Response {
 	}
 	if !_validateInput(data) {
 		log.WithFields(log.Fields{
-			"email": data.Email, "password": data.Password,
+			"email": data.Email,
 		}).Info("Unvalidated login info")
 		fmt.Println("Login failed.")
 		return Response{Error: true, Msg: "Invalid login data"}
 	}
 
+	// Too many failed attempts make the next ones wait, whether the password is right or not
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	ip := clientIP(req)
+	if wait := loginWait(ctx, data.Email, ip); wait > 0 {
+		return Response{Error: true, Msg: fmt.Sprintf("Too many failed attempts, try again in %d seconds", int(math.Ceil(wait.Seconds())))}
+	}
+
 	// Get the password hash from DB
 	UID, hashedPassword, validated, err := DBGetHash(data.Email)
 	if err != nil {
 		log.WithFields(log.Fields{
 			"uid": UID,
 		}).Info("Invalid login data")
+		loginFailed(ctx, data.Email, ip, "")
 		return Response{Error: true, Msg: "Invalid login data"}
 	}
-	if !validated {
-		if codeToEmail(data.Email, UID) != nil {
-			return Response{Error: true, Msg: "failed to send email with code"}
-		}
-		return Response{Error: true, Msg: "Account is not validated. Please check your email to confirm your account"}
-	}
 
 	// Compare the password and the stored hash
 	if bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(data.Password)) == nil {
-		// Create Access and Refresh tokens
-		tokens, err := CreateTokens(UID)
-		if err != nil {
-			return Response{Error: true, Msg: "An error occurred, please try again"}
+		// only told after the password, so it can't be used to probe emails
+		if !validated {
+			return Response{Error: true, Code: "unverified", Msg: "Account is not validated. Please check your email to confirm your account"}
 		}
-		// Success
-		log.WithFields(log.Fields{
-			"uid": UID,
-		}).Info("Successfully logged in")
-		tokensJSON, err := json.Marshal(tokens)
+		// With 2FA on the tokens only come after a code, see userLoginMFA
+		totp, err := DBGetTOTP(UID)
 		if err != nil {
-			return Response{Error: true, Msg: "error processing information"}
+			return Response{Error: true, Msg: "DB Error"}
 		}
-		return Response{Error: false, Data: tokensJSON}
-
+		if totp.Enabled {
+			return mfaChallenge(UID, data.Email, data.Device)
+		}
+		// the failures are only forgotten once the user is in, not before the second factor
+		res := loginTokens(req, UID, data.Device)
+		if !res.Error {
+			loginSucceeded(ctx, data.Email)
+		}
+		return res
 	}
+	log.WithFields(log.Fields{
+		"uid": UID, "ip": ip,
+	}).Info("Wrong password")
+	loginFailed(ctx, data.Email, ip, UID)
 	return Response{Error: true, Msg: "Invalid login data"}
 }
 
+/*loginTokens - creates the access and refresh tokens of a new session, the last step of every way to log in
+*
+ */
+func loginTokens(req *http.Request, UID string, device string) Response {
+	// Create Access and Refresh tokens
+	tokens, err := CreateTokens(newSession(req, UID, device))
+	if err != nil {
+		return Response{Error: true, Msg: "An error occurred, please try again"}
+	}
+	DBTouchUser(UID, requestLanguage(req))
+	// Success
+	log.WithFields(log.Fields{
+		"uid": UID,
+	}).Info("Successfully logged in")
+	tokensJSON, err := json.Marshal(tokens)
+	if err != nil {
+		return Response{Error: true, Msg: "error processing information"}
+	}
+	return Response{Error: false, Data: tokensJSON}
+}
+
 /*
 *
  */
@@ -127,10 +174,16 @@ func userLogout(req *http.Request) Response {
 		return Response{Error: true, Msg: err.Error()}
 	}
 
-	// Delete the access token UUID from Redis, to delete this session
-	deleted, delErr := Logout(tokenAuth.AccessUUID)
-	if delErr != nil || deleted == 0 {
-		return Response{Error: true, Msg: "Unauthorized"}
+	// Delete this session and its tokens from Redis
+	if tokenAuth.SessionID != "" {
+		if RevokeSession(tokenAuth.UID, tokenAuth.SessionID) != nil {
+			return Response{Error: true, Msg: "Unauthorized"}
+		}
+	} else {
+		deleted, delErr := Logout(tokenAuth.AccessUUID)
+		if delErr != nil || deleted == 0 {
+			return Response{Error: true, Msg: "Unauthorized"}
+		}
 	}
 	// Success
 	log.WithFields(log.Fields{
@@ -169,18 +222,137 @@ func userValidate(req *http.Request) Response {
 
 	qParams := req.URL.Query()
 	code := qParams.Get("code")
-	UID, err := codesClient.Get(ctx, code).Result()
+	// the code only names keys under validate:, never any other key of codesClient
+	if !strings.HasPrefix(code, "v") {
+		return Response{Error: true, Msg: "code does not exist or expired"}
+	}
+	UID, err := codesClient.Get(ctx, "validate:"+code).Result()
 	if err != nil {
 		return Response{Error: true, Msg: "code does not exist or expired"}
 	}
+	// only the newest code of the user is valid
+	if current, err := codesClient.Get(ctx, "validate_code:"+UID).Result(); err != nil || current != code {
+		return Response{Error: true, Msg: "code does not exist or expired"}
+	}
 	if DBValidateUser(UID) != nil {
 		return Response{Error: true, Msg: "db error validating user"}
 
 	}
+	codesClient.Del(ctx, "validate:"+code, "validate_code:"+UID)
 	return Response{Error: false}
 
 }
 
+/*userResendValidation - emails a new validation link to an account that is not validated yet
+* Always answers the same, so it can't be used to find which emails have an account
+ */
+func userResendValidation(req *http.Request) Response {
+	var data ForgotPassword
+	decoder := json.NewDecoder(req.Body)
+	if err := decoder.Decode(&data); err != nil {
+		return Response{Error: true, Msg: "Invalid request"}
+	}
+	if !_validateInput(data) {
+		return Response{Error: true, Msg: "Invalid email"}
+	}
+	res := Response{Error: false, Msg: "If the email has an account that is not validated, a link was sent to it"}
+
+	UID, _, validated, err := DBGetHash(data.Email)
+	if err != nil || validated {
+		return res
+	}
+	// a failure must answer the same too, or it would tell the email has an account
+	if err = codeToEmail(data.Email, UID, requestLanguage(req)); err != nil {
+		log.WithFields(log.Fields{
+			"uid": UID,
+		}).Info("Failed to send validation email: ", err)
+	}
+	return res
+}
+
+/*userChangeEmail - sends a confirmation link to the new email of the logged in user
+* The email only changes when the link is opened, see userConfirmEmail
+ */
+func userChangeEmail(req *http.Request) Response {
+	tokenAuth, err := ExtractTokenMetadata(req)
+	if err != nil {
+		return Response{Error: true, Msg: err.Error()}
+	}
+	var data ChangeEmail
+	decoder := json.NewDecoder(req.Body)
+	if err = decoder.Decode(&data); err != nil {
+		return Response{Error: true, Msg: "Invalid request"}
+	}
+	if !_validateInput(data) {
+		return Response{Error: true, Msg: "Invalid email data"}
+	}
+
+	hashedPassword, err := DBGetPasswordHash(tokenAuth.UID)
+	if err != nil {
+		return Response{Error: true, Msg: "DB Error"}
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(data.Password)) != nil {
+		return Response{Error: true, Msg: "Password is wrong"}
+	}
+	if DBExistsUser(data.NewEmail) {
+		return Response{Error: true, Msg: "Email already used by another user."}
+	}
+
+	change := EmailChange{UID: tokenAuth.UID, Email: data.NewEmail, SessionID: tokenAuth.SessionID}
+	if emailChangeToEmail(change, requestLanguage(req)) != nil {
+		return Response{Error: true, Msg: "failed to send email with code"}
+	}
+	return Response{Error: false, Msg: "Check your new email to confirm the change"}
+}
+
+/*userConfirmEmail - switches the email of the user to the one the code was sent to
+* Every session of the user except the one that asked for the change is logged out
+ */
+func userConfirmEmail(req *http.Request) Response {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	code := req.URL.Query().Get("code")
+	if !strings.HasPrefix(code, "e") {
+		return Response{Error: true, Msg: "code does not exist or expired"}
+	}
+	val, err := codesClient.Get(ctx, "email_change:"+code).Result()
+	if err != nil {
+		return Response{Error: true, Msg: "code does not exist or expired"}
+	}
+	var change EmailChange
+	if err = json.Unmarshal([]byte(val), &change); err != nil {
+		return Response{Error: true, Msg: "code does not exist or expired"}
+	}
+	// single use, if two requests race only the one that deletes it continues
+	if deleted, err := codesClient.Del(ctx, "email_change:"+code).Result(); err != nil || deleted == 0 {
+		return Response{Error: true, Msg: "code does not exist or expired"}
+	}
+	if DBExistsUser(change.Email) { // someone signed up with it in the meantime
+		return Response{Error: true, Msg: "Email already used by another user."}
+	}
+
+	u, err := DBGetUser(change.UID)
+	if err != nil {
+		return Response{Error: true, Msg: "DB Error"}
+	}
+	if DBUpdateEmail(change.UID, change.Email) != nil {
+		return Response{Error: true, Msg: "DB Error"}
+	}
+	if RevokeOtherTokens(change.UID, change.SessionID) != nil {
+		return Response{Error: true, Msg: "Email changed but could not log out other sessions"}
+	}
+	log.WithFields(log.Fields{
+		"uid": change.UID,
+	}).Info("Email changed")
+
+	// let the old address know, in case it was not the owner who changed it
+	if err = sendEmail(u.Email, "email_changed", u.Lang, map[string]string{"Email": change.Email}); err != nil {
+		fmt.Println("failed to notify old email:", err)
+	}
+	return Response{Error: false, Msg: "Email changed successfully"}
+}
+
 /*
 *
  */
@@ -211,6 +383,11 @@ func userSignup(req *http.Request) Response {
 	u1.LastAccess = time.Now().Unix()
 	u1.UID = "u" + ksuid.New().String()
 	u1.ValidatedAccount = false
+	u1.Lang = requestLanguage(req)
+	// the body is a whole User, only the username, email and password come from the client
+	u1.Image = ""
+	u1.LastChangedName = 0
+	u1.Settings = UserSettings{}.withDefaults()
 
 	hash, err := bcrypt.GenerateFromPassword([]byte(u1.Password), 12)
 	u1.Password = string(hash)
@@ -219,7 +396,7 @@ func userSignup(req *http.Request) Response {
 
 	}
 	//send verification e-mail
-	if codeToEmail(u1.Email, u1.UID) != nil {
+	if codeToEmail(u1.Email, u1.UID, requestLanguage(req)) != nil {
 		return Response{Error: true, Msg: "failed to send email with code"}
 
 	}
@@ -249,10 +426,13 @@ func userLocation(req *http.Request) Response {
 
 	}
 	UID := tokenAuth.UID
-	DBUpdateLocation(&l, UID)
+	DBUpdateLocation(&l, UID) // does nothing if the user turned the location off
 	return Response{Error: false, Msg: "location updated successfully"}
 }
 
+/*userImages - changes the profile image of the user
+* The image is sent as a jpeg in the image field of a multipart form
+ */
 func userImages(req *http.Request) Response {
 	tokenAuth, err := ExtractTokenMetadata(req)
 	if err != nil {
@@ -267,17 +447,33 @@ func userImages(req *http.Request) Response {
 	}
 	defer file.Close()
 
-	//send image to image server
-	//return link
-	// save link in user.image
-
-	destination, err := os.Create(fmt.Sprintf("images/image_%s.jpg", tokenAuth.UID))
+	img, err := jpeg.Decode(file)
+	if err != nil {
+		return Response{Error: true, Msg: "can't read image"}
+	}
+	imageURL, err := uploadImage(JpegToBytes(img))
 	if err != nil {
+		fmt.Println("error uploading image:", err)
 		return Response{Error: true, Msg: "can't save image"}
 	}
-	io.Copy(destination, file)
+	oldURL, err := DBUpdateUserImage(tokenAuth.UID, imageURL)
+	if err != nil {
+		deleteImage(imageURL)
+		return Response{Error: true, Msg: "DB Error"}
+	}
+	if oldURL != "" {
+		if err := deleteImage(oldURL); err != nil {
+			log.WithFields(log.Fields{
+				"uid": tokenAuth.UID, "image": oldURL,
+			}).Info("Failed to delete old profile image")
+		}
+	}
 
-	return Response{Error: false}
+	imageJSON, err := json.Marshal(bson.M{"image": imageURL})
+	if err != nil {
+		return Response{Error: true, Msg: "error processing information"}
+	}
+	return Response{Error: false, Data: imageJSON}
 }
 
 /*
@@ -304,41 +500,74 @@ func userUpdateUsername(req *http.Request) Response {
 	return Response{Error: false}
 }
 
-/*
-*
+/*codeToEmail - emails a link with a new code that validates the account of uid, in the language lang
+* The new code replaces the previous one. At most one email per validationEmailInterval and validationEmailsPerHour are sent
  */
-func sendEmail(email, code string) (string, error) {
-	mg := mailgun.NewMailgun(DOMAIN, APIKEY)
-	m := mg.NewMessage(
-		"Mappin App <mappin@hadrons.xyz>",
-		"Confirm your account",
-		"Use this code: "+code,
-		email,
-	)
-
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*50)
+func codeToEmail(email, uid, lang string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	_, id, err := mg.Send(ctx, m)
-	return id, err
+	sent, err := codesClient.SetNX(ctx, "validate_sent:"+email, 1, validationEmailInterval).Result()
+	if err != nil {
+		return err
+	}
+	if !sent {
+		return nil
+	}
+	hourKey := "validate_hour:" + email
+	count, err := codesClient.Incr(ctx, hourKey).Result()
+	if err != nil {
+		return err
+	}
+	if count == 1 {
+		codesClient.Expire(ctx, hourKey, time.Hour)
+	}
+	if count > validationEmailsPerHour {
+		return nil
+	}
+
+	code := "v" + uuid.NewV4().String()
+	duration, err := time.ParseDuration("24h")
+	if err != nil {
+		return err
+	}
+	currentKey := "validate_code:" + uid
+	old, _ := codesClient.Get(ctx, currentKey).Result()
+	_, err = codesClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		if old != "" {
+			pipe.Del(ctx, "validate:"+old)
+		}
+		pipe.Set(ctx, "validate:"+code, uid, duration)
+		pipe.Set(ctx, currentKey, code, duration)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	url := config.PublicURL + "/users/validate?code=" + code
+	err = sendEmail(email, "verification", lang, map[string]string{"Link": url}) // used this bcs independent of time. It is not good to generate tokens that are time dependent.
+	if err != nil {
+		return err
+	}
+	return nil
 }
 
-/*
+/*emailChangeToEmail - emails a link with a new code that confirms the email change
+*
  */
-func codeToEmail(email, uid string) error {
+func emailChangeToEmail(change EmailChange, lang string) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	code := "v" + uuid.NewV4().String()
-	duration, err := time.ParseDuration("24h")
+	val, err := json.Marshal(change)
 	if err != nil {
 		return err
 	}
-	codesClient.Set(ctx, code, uid, duration)
-	url := "https://mappin.hadrons.xyz/users/validate?code=" + code
-	_, err = sendEmail(email, url) // used this bcs independent of time. It is not good to generate tokens that are time dependent.
+	code := "e" + uuid.NewV4().String()
+	err = codesClient.Set(ctx, "email_change:"+code, val, 24*time.Hour).Err()
 	if err != nil {
 		return err
 	}
-	return nil
+	url := config.PublicURL + "/users/email/confirm?code=" + code
+	return sendEmail(change.Email, "email_change", lang, map[string]string{"Link": url})
 }